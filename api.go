@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+var (
+	reAPIJobPath = regexp.MustCompile(`^/api/v1/jobs/([a-z0-9-]+)(?:/(signal|stop))?$`)
+)
+
+type apiError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+type deployableInfo struct {
+	ID       string        `json:"ID"`
+	Desc     string        `json:"Desc"`
+	Public   bool          `json:"Public"`
+	Params   []deployParam `json:"Params"`
+	Profiles []string      `json:"Profiles"`
+}
+
+type jobStatus struct {
+	ID         string            `json:"ID"`
+	Owner      user              `json:"Owner"`
+	Deployable string            `json:"Deployable"`
+	Params     map[string]string `json:"Params"`
+	Profile    string            `json:"Profile,omitempty"`
+	Public     bool              `json:"Public"`
+
+	GatewayURL string `json:"GatewayURL"`
+	LogURL     string `json:"LogURL"`
+
+	GuestIP   string          `json:"GuestIP"`
+	GuestIP6  string          `json:"GuestIP6,omitempty"`
+	Bandwidth bandwidthLimits `json:"Bandwidth"`
+
+	State      string    `json:"State"`
+	Started    bool      `json:"Started"`
+	StartTime  time.Time `json:"StartTime"`
+	Finished   bool      `json:"Finished"`
+	FinishTime time.Time `json:"FinishTime"`
+
+	EntryPid   int    `json:"EntryPid"`
+	ExitCode   *int   `json:"ExitCode,omitempty"`
+	ExitSignal string `json:"ExitSignal,omitempty"`
+	Outcome    string `json:"Outcome,omitempty"`
+	FailReason string `json:"FailReason,omitempty"`
+
+	LastActivity time.Time `json:"LastActivity"`
+
+	Usage *cgroupUsage `json:"Usage"`
+}
+
+func (j *job) Status() jobStatus {
+	usage := j.Usage()
+	state := j.State()
+
+	j.Statem.RLock()
+	defer j.Statem.RUnlock()
+
+	var exitCode *int
+	if j.EntryExited {
+		exitCode = new(int)
+		*exitCode = j.ExitCode
+	}
+
+	return jobStatus{
+		ID:         j.ID,
+		Owner:      j.Owner,
+		Deployable: j.Deployable,
+		Params:     j.Params,
+		Profile:    j.Profile,
+		Public:     j.Public,
+		GatewayURL: Link("/enter/" + j.ID + "/"),
+		LogURL:     Link("/jobs/" + j.ID + "/log"),
+		GuestIP:    j.GuestIP,
+		GuestIP6:   j.GuestIP6,
+		Bandwidth:  j.Bandwidth,
+		State:      state,
+		Started:    j.Started,
+		StartTime:  j.StartTime,
+		Finished:   j.Finished,
+		FinishTime: j.FinishTime,
+
+		EntryPid:   j.EntryPid,
+		ExitCode:   exitCode,
+		ExitSignal: j.ExitSignal,
+		Outcome:    j.Outcome,
+		FailReason: j.FailReason,
+
+		LastActivity: j.LastActivity,
+
+		Usage: usage,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("encoding API response: %s", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code string, msg string) {
+	writeJSON(w, status, map[string]apiError{
+		"Error": {Code: code, Message: msg},
+	})
+}
+
+/* writeAPIJobError maps errors of the jobs map onto structured API errors */
+func writeAPIJobError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*quotaError); ok {
+		writeAPIError(w, http.StatusTooManyRequests, "quota_exceeded", err.Error())
+		return
+	}
+
+	switch err {
+	case errJobNotFound:
+		writeAPIError(w, http.StatusNotFound, "job_not_found", err.Error())
+	case errJobExists:
+		writeAPIError(w, http.StatusConflict, "job_exists", err.Error())
+	case errBadJobID:
+		writeAPIError(w, http.StatusBadRequest, "bad_job_id", err.Error())
+	case errJobNotFinished:
+		writeAPIError(w, http.StatusConflict, "job_not_finished", err.Error())
+	case errJobNotRunning:
+		writeAPIError(w, http.StatusConflict, "job_not_running", err.Error())
+	case errAddrPoolExhausted:
+		writeAPIError(w, http.StatusServiceUnavailable, "addresses_exhausted", err.Error())
+	case errForbidden:
+		writeAPIError(w, http.StatusForbidden, "forbidden", err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "internal", err.Error())
+	}
+}
+
+func handleAPI(w http.ResponseWriter, r *http.Request, u user) {
+	switch {
+	case r.URL.Path == "/api/v1/deployables":
+		apiDeployables(w, r, u)
+	case r.URL.Path == "/api/v1/jobs":
+		apiJobs(w, r, u)
+	case reAPIJobPath.MatchString(r.URL.Path):
+		apiJob(w, r, u)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", "no such API endpoint")
+	}
+}
+
+func apiDeployables(w http.ResponseWriter, r *http.Request, u user) {
+	if r.Method != "GET" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "bad_method", "method not allowed")
+		return
+	}
+
+	ret := []deployableInfo{}
+	for _, d := range getDeployables() {
+		var profiles []string
+		for _, p := range d.allowedProfiles(u) {
+			profiles = append(profiles, p.ID)
+		}
+		ret = append(ret, deployableInfo{d.ID, d.Desc, d.Public, d.Params, profiles})
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func apiJobs(w http.ResponseWriter, r *http.Request, u user) {
+	switch r.Method {
+	case "GET":
+		ret := []jobStatus{}
+		jobs.RLock()
+		for _, job := range jobs.m {
+			if u.CanManageJob(job) {
+				ret = append(ret, job.Status())
+			}
+		}
+		jobs.RUnlock()
+		writeJSON(w, http.StatusOK, ret)
+
+	case "POST":
+		var req struct {
+			Deployable string                 `json:"Deployable"`
+			Params     map[string]interface{} `json:"Params"`
+			Profile    string                 `json:"Profile"`
+		}
+		/* numbers are kept as written, as floats would turn 1000000 into 1e+06 */
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		err := dec.Decode(&req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		d := lookupEnv(req.Deployable)
+		if d == nil {
+			writeAPIError(w, http.StatusNotFound, "deployable_not_found", "deployable not found")
+			return
+		}
+
+		params, err := d.parseParams(func(name string) (string, bool) {
+			v, ok := req.Params[name]
+			if !ok {
+				return "", false
+			}
+			return fmt.Sprint(v), true
+		})
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_params", err.Error())
+			return
+		}
+
+		profile, err := d.pickProfile(u, req.Profile)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_profile", err.Error())
+			return
+		}
+
+		job, err := deployJob(d, u, params, profile)
+		if err != nil && job != nil {
+			writeAPIError(w, http.StatusInternalServerError, "failed_to_start",
+				fmt.Sprintf("job %s failed to start: %s", job.ID, err))
+			return
+		}
+		if err != nil {
+			writeAPIJobError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, job.Status())
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "bad_method", "method not allowed")
+	}
+}
+
+func apiJob(w http.ResponseWriter, r *http.Request, u user) {
+	match := reAPIJobPath.FindStringSubmatch(r.URL.Path)
+	job := jobs.Lookup(match[1])
+	if job == nil {
+		writeAPIJobError(w, errJobNotFound)
+		return
+	}
+	if !u.CanManageJob(job) {
+		writeAPIJobError(w, errForbidden)
+		return
+	}
+
+	switch {
+	case match[2] == "" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, job.Status())
+
+	case match[2] == "" && r.Method == "DELETE":
+		err := jobs.Remove(job.ID)
+		if err != nil {
+			writeAPIJobError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case match[2] == "signal" && r.Method == "POST":
+		var req struct {
+			Signal int `json:"Signal"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Signal <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "no signal number")
+			return
+		}
+		err = job.SendSignal(syscall.Signal(req.Signal))
+		if err != nil {
+			writeAPIJobError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, job.Status())
+
+	case match[2] == "stop" && r.Method == "POST":
+		go job.Stop()
+		writeJSON(w, http.StatusAccepted, job.Status())
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "bad_method", "method not allowed")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIDeployParams(t *testing.T) {
+	defer func(v interface{}) {
+		if v != nil {
+			deployables.Store(v)
+		}
+	}(deployables.Load())
+	deployables.Store([]Deployable{{
+		ID: "app",
+		Params: []deployParam{
+			{Name: "count", Type: "int", Default: "1"},
+			{Name: "debug", Type: "bool", Default: "false"},
+			{Name: "name", Type: "string"},
+		},
+	}})
+
+	/* the deployable lists no profiles, so asking for one fails right after
+	   the parameters have been validated */
+	tests := []struct {
+		params string
+		code   string
+	}{
+		{`{}`, "bad_profile"},
+		{`{"count": 1000000}`, "bad_profile"},
+		{`{"count": 12345678901}`, "bad_profile"},
+		{`{"count": -7}`, "bad_profile"},
+		{`{"count": "42"}`, "bad_profile"},
+		{`{"count": 1.5}`, "bad_params"},
+		{`{"count": 1e6}`, "bad_params"},
+		{`{"count": "many"}`, "bad_params"},
+		{`{"debug": true}`, "bad_profile"},
+		{`{"debug": "maybe"}`, "bad_params"},
+		{`{"name": "x y"}`, "bad_profile"},
+	}
+
+	for _, tt := range tests {
+		body := `{"Deployable": "app", "Profile": "none", "Params": ` + tt.params + `}`
+		r := httptest.NewRequest("POST", "/api/v1/jobs", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handleAPI(w, r, "alice")
+
+		var resp map[string]apiError
+		err := json.NewDecoder(w.Body).Decode(&resp)
+		if err != nil {
+			t.Errorf("params %s: decoding response: %s", tt.params, err)
+			continue
+		}
+		if w.Code != http.StatusBadRequest || resp["Error"].Code != tt.code {
+			t.Errorf("params %s: got %d %+v, want %d %s", tt.params, w.Code, resp["Error"], http.StatusBadRequest, tt.code)
+		}
+	}
+}
@@ -7,10 +7,16 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"golang.org/x/sys/unix"
@@ -91,6 +97,88 @@ func initCgroup() {
 	}
 
 	cgroupAttach(cgroupOurPath)
+
+	enableCgroupControllers(path.Dir(cgroupJobsPath))
+	enableCgroupControllers(cgroupJobsPath)
+
+	userLimits, err = parseCgroupLimits(*flagUserLimits)
+	if err == nil {
+		err = userLimits.check(cgroupJobsPath)
+	}
+	if err != nil {
+		log.Fatalf("bad per-user cgroup limits: %s", err)
+	}
+}
+
+/* enableCgroupControllers delegates all controllers available in dir to its children */
+func enableCgroupControllers(dir string) {
+	contents, err := ioutil.ReadFile(path.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		log.Printf("could not read available cgroup controllers: %s", err)
+		return
+	}
+	for _, c := range strings.Fields(string(contents)) {
+		err = ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte("+"+c+"\n"), 0755)
+		if err != nil {
+			log.Printf("could not enable cgroup controller %s in %s: %s", c, dir, err)
+		}
+	}
+}
+
+func cgroupSubtreeControllers(dir string) (map[string]bool, error) {
+	contents, err := ioutil.ReadFile(path.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool)
+	for _, c := range strings.Fields(string(contents)) {
+		ret[c] = true
+	}
+	return ret, nil
+}
+
+/* cgroupLimits maps cgroup interface files to the values to be written to them */
+type cgroupLimits map[string]string
+
+var allowedCgroupLimits = map[string]bool{
+	"memory.max":  true,
+	"memory.high": true,
+	"cpu.max":     true,
+	"cpu.weight":  true,
+	"pids.max":    true,
+	"io.max":      true,
+}
+
+/* check verifies the limits can be applied to cgroups created under parent */
+func (l cgroupLimits) check(parent string) error {
+	if len(l) == 0 {
+		return nil
+	}
+
+	enabled, err := cgroupSubtreeControllers(parent)
+	if err != nil {
+		return err
+	}
+	for file := range l {
+		if !allowedCgroupLimits[file] {
+			return fmt.Errorf("unsupported cgroup limit %s", file)
+		}
+		controller := strings.SplitN(file, ".", 2)[0]
+		if !enabled[controller] {
+			return fmt.Errorf("cgroup controller %s not enabled in %s", controller, parent)
+		}
+	}
+	return nil
+}
+
+func (l cgroupLimits) apply(dir string) error {
+	for file, value := range l {
+		err := ioutil.WriteFile(path.Join(dir, file), []byte(value+"\n"), 0755)
+		if err != nil {
+			return fmt.Errorf("setting %s: %s", file, err)
+		}
+	}
+	return nil
 }
 
 func internalCgroupExec(flagArg string) {
@@ -117,11 +205,11 @@ func isCgroupPopulated(dir string) (ret bool) {
 
 	eventsFn := path.Join(dir, "cgroup.events")
 	f, err := os.OpenFile(eventsFn, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return false
+	}
 	if err != nil {
 		log.Printf("can't read %s: %v\n", eventsFn, err)
-		if err == os.ErrNotExist {
-			ret = false
-		}
 		return
 	}
 	defer f.Close()
@@ -149,7 +237,16 @@ func waitForCgroupUnpopulated(dir string) chan interface{} {
 			return
 		}
 		defer watcher.Close()
+
+		/* without a watch, e.g. with the cgroup gone, fall back to polling */
+		var poll <-chan time.Time
 		err = watcher.Add(path.Join(dir, "cgroup.events"))
+		if err != nil && isCgroupPopulated(dir) {
+			log.Printf("watching %s: %s", dir, err)
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
 
 		for {
 			if !isCgroupPopulated(dir) {
@@ -157,6 +254,7 @@ func waitForCgroupUnpopulated(dir string) chan interface{} {
 			}
 
 			select {
+			case <-poll:
 			case event, ok := <-watcher.Events:
 				if !ok {
 					return
@@ -173,9 +271,228 @@ func waitForCgroupUnpopulated(dir string) chan interface{} {
 	return ret
 }
 
-func createCgroup(dir string) {
-	err := os.MkdirAll(dir, 0755)
+/* per-user cgroups group the cgroups of a user's jobs below cgroupJobsPath */
+const userCgroupPrefix = "user-"
+
+var (
+	flagUserLimits = flag.String("user_limits", "", "semicolon-separated cgroup limits applied to the jobs of each user together, e.g. 'memory.max=8G;cpu.max=400000 100000'")
+
+	userLimits cgroupLimits
+
+	/* serializes creation and removal of per-user cgroups */
+	userCgroupsMu sync.Mutex
+)
+
+func parseCgroupLimits(s string) (cgroupLimits, error) {
+	ret := make(cgroupLimits)
+	for _, kv := range strings.Split(s, ";") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		f := strings.SplitN(kv, "=", 2)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("bad cgroup limit %q", kv)
+		}
+		ret[strings.TrimSpace(f[0])] = strings.TrimSpace(f[1])
+	}
+	return ret, nil
+}
+
+func userCgroupPath(u user) string {
+	return path.Join(cgroupJobsPath, userCgroupPrefix+url.PathEscape(string(u)))
+}
+
+/* createJobCgroup creates the cgroup for job id nested in the cgroup of its owner */
+func createJobCgroup(owner user, id string) (string, error) {
+	userCgroupsMu.Lock()
+	defer userCgroupsMu.Unlock()
+
+	userDir := userCgroupPath(owner)
+	err := os.Mkdir(userDir, 0755)
+	created := err == nil
+	if created {
+		enableCgroupControllers(userDir)
+	} else if !os.IsExist(err) {
+		return "", err
+	}
+	err = userLimits.apply(userDir)
 	if err != nil {
-		log.Printf("could not create cgroup: %s", err)
+		if created {
+			syscall.Rmdir(userDir)
+		}
+		return "", err
+	}
+
+	dir := path.Join(userDir, id)
+	err = os.Mkdir(dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return "", err
 	}
+	return dir, nil
+}
+
+/* releaseUserCgroup removes the per-user cgroup at dir unless other jobs still use it */
+func releaseUserCgroup(dir string) {
+	userCgroupsMu.Lock()
+	defer userCgroupsMu.Unlock()
+
+	err := syscall.Rmdir(dir)
+	if err != nil && err != syscall.EBUSY && err != syscall.ENOTEMPTY && err != syscall.ENOENT {
+		log.Printf("removing user cgroup %s: %s", dir, err)
+	}
+}
+
+/* removeJobCgroup removes the cgroup of a job, and that of its owner if it was the last */
+func removeJobCgroup(dir string) error {
+	err := removeCgroupTree(dir)
+	if parent := path.Dir(dir); parent != cgroupJobsPath {
+		releaseUserCgroup(parent)
+	}
+	return err
+}
+
+/* cgroupMemberPids lists the processes in the subtree rooted at dir, lowest first */
+func cgroupMemberPids(dir string) (ret []int) {
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() != "cgroup.procs" {
+			return nil
+		}
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		for _, f := range strings.Fields(string(contents)) {
+			pid, err := strconv.Atoi(f)
+			if err == nil {
+				ret = append(ret, pid)
+			}
+		}
+		return nil
+	})
+	sort.Ints(ret)
+	return
+}
+
+func killCgroup(dir string) {
+	err := ioutil.WriteFile(path.Join(dir, "cgroup.kill"), []byte("1\n"), 0755)
+	if err == nil {
+		return
+	}
+
+	/* cgroup.kill is missing on kernels older than 5.14 */
+	for _, pid := range cgroupMemberPids(dir) {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+/* removeCgroupTree removes dir along with any cgroups nested below it */
+func removeCgroupTree(dir string) error {
+	var dirs []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = syscall.Rmdir(dirs[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* cgroupUsage is a snapshot of the resource usage statistics of a cgroup */
+type cgroupUsage struct {
+	MemoryCurrent uint64 `json:"MemoryCurrent"`
+	MemoryPeak    uint64 `json:"MemoryPeak"`
+	CPUUsageUsec  uint64 `json:"CPUUsageUsec"`
+	CPUUserUsec   uint64 `json:"CPUUserUsec"`
+	CPUSystemUsec uint64 `json:"CPUSystemUsec"`
+	PidsCurrent   uint64 `json:"PidsCurrent"`
+	IOReadBytes   uint64 `json:"IOReadBytes"`
+	IOWriteBytes  uint64 `json:"IOWriteBytes"`
+}
+
+func (u *cgroupUsage) CPUTime() time.Duration {
+	return time.Duration(u.CPUUsageUsec) * time.Microsecond
+}
+
+func readCgroupUint(dir string, file string) uint64 {
+	contents, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return 0
+	}
+	v, _ := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	return v
+}
+
+/* readCgroupKeyed calls fn on every "key value" pair found in a flat-keyed or nested-keyed file */
+func readCgroupKeyed(dir string, file string, fn func(key string, value uint64)) {
+	contents, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return
+	}
+	for _, f := range strings.Fields(string(contents)) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(kv[1], 10, 64)
+		if err == nil {
+			fn(kv[0], v)
+		}
+	}
+}
+
+/* readCgroupUsage leaves zero the fields of controllers not enabled on dir */
+func readCgroupUsage(dir string) (*cgroupUsage, error) {
+	_, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &cgroupUsage{
+		MemoryCurrent: readCgroupUint(dir, "memory.current"),
+		MemoryPeak:    readCgroupUint(dir, "memory.peak"),
+		PidsCurrent:   readCgroupUint(dir, "pids.current"),
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "cpu.stat"))
+	if err == nil {
+		for _, l := range strings.Split(string(contents), "\n") {
+			var key string
+			var val uint64
+			if n, _ := fmt.Sscanf(l, "%s %d", &key, &val); n != 2 {
+				continue
+			}
+			switch key {
+			case "usage_usec":
+				u.CPUUsageUsec = val
+			case "user_usec":
+				u.CPUUserUsec = val
+			case "system_usec":
+				u.CPUSystemUsec = val
+			}
+		}
+	}
+
+	readCgroupKeyed(dir, "io.stat", func(key string, value uint64) {
+		switch key {
+		case "rbytes":
+			u.IOReadBytes += value
+		case "wbytes":
+			u.IOWriteBytes += value
+		}
+	})
+
+	return u, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -10,6 +11,7 @@ import (
 	"bytes"
 	"errors"
 	"strings"
+	"sync"
 	//	"net/http"
 
 	"github.com/vishvananda/netns"
@@ -37,6 +39,7 @@ type dialResp struct {
 }
 
 type dialReq struct {
+	ctx     context.Context
 	network string
 	address string
 	resch   chan<- dialResp
@@ -49,19 +52,22 @@ type pinnedDialer struct {
 	/* waited on anywhere, closed in loop/Quit */
 	readych chan interface{}
 	quitch  chan interface{}
+
+	quitOnce sync.Once
 }
 
 func CreatePinnedDialer() *pinnedDialer {
 	return &pinnedDialer{
-		make(chan dialReq),
-		make(chan interface{}),
-		make(chan interface{}),
+		reqch:   make(chan dialReq),
+		readych: make(chan interface{}),
+		quitch:  make(chan interface{}),
 	}
 }
 
 func (d *pinnedDialer) loop() {
 	var req dialReq
 	var resp dialResp
+	var dialer net.Dialer
 
 	close(d.readych)
 
@@ -72,7 +78,7 @@ func (d *pinnedDialer) loop() {
 		case req = <-d.reqch:
 		}
 
-		resp.Conn, resp.error = net.Dial(req.network, req.address)
+		resp.Conn, resp.error = dialer.DialContext(req.ctx, req.network, req.address)
 		req.resch <- resp
 	}
 }
@@ -93,12 +99,20 @@ func (d *pinnedDialer) WaitReady() <-chan interface{} {
 }
 
 func (d *pinnedDialer) Quit() {
-	close(d.quitch)
+	d.quitOnce.Do(func() {
+		close(d.quitch)
+	})
 }
 
 func (d *pinnedDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+/* DialContext is Dial giving up once ctx is done */
+func (d *pinnedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	resch := make(chan dialResp)
 	req := dialReq{
+		ctx:     ctx,
 		network: network,
 		address: address,
 		resch:   resch,
@@ -107,6 +121,8 @@ func (d *pinnedDialer) Dial(network, address string) (net.Conn, error) {
 	select {
 	case <-d.quitch:
 		return nil, errConnClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case d.reqch <- req:
 	}
 
@@ -117,20 +133,78 @@ func (d *pinnedDialer) Dial(network, address string) (net.Conn, error) {
 	return res.Conn, res.error
 }
 
-var hostIfCounter int = 0
+/* naming and addressing of the veth pair of a job */
+type vethInfo struct {
+	HostIf    string
+	HostIP    string
+	GuestIP   string
+	PrefixLen int
+
+	/* empty unless the job is dual-stack */
+	HostIP6    string
+	GuestIP6   string
+	PrefixLen6 int
+}
+
+/* startError is a failure to get the entry process of a job running */
+type startError struct {
+	Reason string
+	Err    error
+}
+
+func (e *startError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Err)
+}
+
+func (e *startError) Unwrap() error {
+	return e.Err
+}
+
+/* launchSpec is what it takes to launch a job in its own cgroup and network namespace */
+type launchSpec struct {
+	Owner user
+
+	Argv   []string
+	Env    []string
+	Dir    string
+	Cgroup string
+	Stderr *os.File
+
+	Dialer    *pinnedDialer
+	Veth      vethInfo
+	Egress    egressPolicy
+	Bandwidth bandwidthLimits
+}
+
+/* what became of a contained run, as reported back to the job */
+type runResult struct {
+	EntryPid   int
+	EntryState *os.ProcessState
+	StartErr   *startError
+}
+
+const hostIfPrefix = "ve-envdeploy"
 
-func allocHostIfName() (name string) {
-	name = fmt.Sprintf("ve-envdeploy%d", hostIfCounter)
-	hostIfCounter += 1
-	return
+/* deleteVeth deletes the veth pair of a job along with its firewall rules */
+func deleteVeth(hostIf string, output *os.File) {
+	runInBackgroundNetns(func() error {
+		cmd := exec.Command("ip", "link", "delete", hostIf)
+		cmd.Stdout = output
+		cmd.Stderr = output
+		cmd.Run()
+		err := removeJobFirewall(hostIf)
+		if err != nil {
+			fmt.Fprintf(output, "envdeploy: removing firewall rules: %s\n", err)
+		}
+		return nil
+	})
 }
 
-func runContainedWithDialerThread(id string, cmd string, env []string, dir string, cgroupPath string, stderr *os.File, pd *pinnedDialer, donech chan<- interface{}) {
+func runContainedWithDialerThread(spec *launchSpec, res *runResult, donech chan<- interface{}) {
 	var proc *os.Process
 	var state *os.ProcessState
 	var err error
 	var path string
-	var argv []string
 
 	bgNetns, _ := netns.Get()
 
@@ -143,15 +217,21 @@ func runContainedWithDialerThread(id string, cmd string, env []string, dir strin
 		close(donech)
 	}
 	defer done()
+	/* only once the veth pair is gone can its addresses be handed out again */
+	defer releaseVeth(spec.Veth.HostIf)
+
+	fail := func(reason string, err error) {
+		res.StartErr = &startError{reason, err}
+		fmt.Fprintf(spec.Stderr, "envdeploy: %s\n", res.StartErr)
+	}
 
-	argv = strings.Split(cmd, " ")
-	if len(argv) == 0 {
-		fmt.Fprintf(stderr, "envdeploy: no command to run\n")
+	if len(spec.Argv) == 0 {
+		fail("bad launch command", errNoCommand)
 		return
 	}
-	path, err = exec.LookPath(argv[0])
+	path, err = exec.LookPath(spec.Argv[0])
 	if err != nil {
-		fmt.Fprintf(stderr, "envdeploy: %s\n", err)
+		fail("command lookup failed", err)
 		return
 	}
 
@@ -160,7 +240,7 @@ func runContainedWithDialerThread(id string, cmd string, env []string, dir strin
 
 	newns, err := netns.New()
 	if err != nil {
-		fmt.Fprintf(stderr, "envdeploy: network namespace creation failed: %s\n", err)
+		fail("network namespace creation failed", err)
 		return
 	}
 	defer func() {
@@ -168,99 +248,145 @@ func runContainedWithDialerThread(id string, cmd string, env []string, dir strin
 		netns.Set(bgNetns)
 	}()
 
-	hostIf := allocHostIfName()
+	hostIf, hostIp, guestIp := spec.Veth.HostIf, spec.Veth.HostIP, spec.Veth.GuestIP
+	prefix := fmt.Sprintf("/%d", spec.Veth.PrefixLen)
+	prefix6 := fmt.Sprintf("/%d", spec.Veth.PrefixLen6)
 
-	runInBackgroundNetns(func() error {
-		cmd := exec.Command("ip", "link", "delete", hostIf)
-		cmd.Stdout = devNull
-		cmd.Stderr = devNull
-		cmd.Run()
-		return nil
+	/* a stale interface could only be left over by a crashed server */
+	deleteVeth(hostIf, devNull)
+	defer deleteVeth(hostIf, spec.Stderr)
+
+	/* rules go in first so that no traffic of the job escapes them */
+	err = runInBackgroundNetns(func() error {
+		return installJobFirewall(hostIf, spec.Owner, spec.Egress)
 	})
+	if err != nil {
+		fail("could not install firewall rules", err)
+		return
+	}
 
 	err = createRouteFromCurrentNetns(hostIf)
 	if err != nil {
-		fmt.Fprintf(stderr, "envdeploy: failed to create veth interface pair: %s\n", err)
+		fail("failed to create veth interface pair", err)
+		return
 	}
 
-	defer func() {
-		runInBackgroundNetns(func() error {
-			cmd := exec.Command("ip", "link", "delete", hostIf)
-			cmd.Stdout = stderr
-			cmd.Stderr = stderr
-			cmd.Run()
-			return nil
-		})
-	}()
-
-	hostIp := fmt.Sprintf("10.0.%d.%d", (hostIfCounter/127)%256, (hostIfCounter%127)*2+0)
-	guestIp := fmt.Sprintf("10.0.%d.%d", (hostIfCounter/127)%256, (hostIfCounter%127)*2+1)
-
 	err = runInBackgroundNetns(func() error {
 		var cmd *exec.Cmd
 		var err error
 
 		cmd = exec.Command("ip", "link", "set", "dev", hostIf, "up")
-		cmd.Stdout = stderr
-		cmd.Stderr = stderr
+		cmd.Stdout = spec.Stderr
+		cmd.Stderr = spec.Stderr
 		err = cmd.Run()
 		if err != nil {
 			return err
 		}
-		cmd = exec.Command("ip", "addr", "add", hostIp+"/31", "dev", hostIf)
-		cmd.Stdout = stderr
-		cmd.Stderr = stderr
+		cmd = exec.Command("ip", "addr", "add", hostIp+prefix, "dev", hostIf)
+		cmd.Stdout = spec.Stderr
+		cmd.Stderr = spec.Stderr
 		err = cmd.Run()
 		if err != nil {
 			return err
 		}
-		return nil
+		if spec.Veth.HostIP6 == "" {
+			return nil
+		}
+		cmd = exec.Command("ip", "-6", "addr", "add", spec.Veth.HostIP6+prefix6, "dev", hostIf, "nodad")
+		cmd.Stdout = spec.Stderr
+		cmd.Stderr = spec.Stderr
+		return cmd.Run()
+	})
+	if err != nil {
+		fail("could not set up host veth interface", err)
+		return
+	}
+
+	err = runInBackgroundNetns(func() error {
+		return shapeHostIf(hostIf, spec.Bandwidth)
 	})
 	if err != nil {
-		fmt.Fprintf(stderr, "envdeploy: could not set up host veth interface: %s\n", err)
+		fail("could not set up bandwidth limits", err)
 		return
 	}
 
 	guestCmds := [][]string{
 		{"ip", "link", "set", "dev", "lo", "up"},
 		{"ip", "link", "set", "dev", "eth1", "up"},
-		{"ip", "addr", "add", guestIp + "/31", "dev", "eth1"},
+		{"ip", "addr", "add", guestIp + prefix, "dev", "eth1"},
 		{"ip", "route", "add", hostIp, "dev", "eth1"},
 		{"ip", "route", "add", "default", "via", hostIp},
 	}
+	if spec.Veth.HostIP6 != "" {
+		/* without DAD the addresses are usable right away */
+		guestCmds = append(guestCmds,
+			[]string{"ip", "-6", "addr", "add", spec.Veth.GuestIP6 + prefix6, "dev", "eth1", "nodad"},
+			[]string{"ip", "-6", "route", "add", "default", "via", spec.Veth.HostIP6, "dev", "eth1"},
+		)
+	}
 
 	for _, cmds := range guestCmds {
 		err = exec.Command(cmds[0], cmds[1:]...).Run()
 		if err != nil {
-			fmt.Fprintf(stderr, "envdeploy: error executing '%s': %s\n", strings.Join(cmds, " "), err)
+			fail(fmt.Sprintf("error executing '%s'", strings.Join(cmds, " ")), err)
 			return
 		}
 	}
 
-	proc, err = startProcessInCgroup(path, argv, env, dir, cgroupPath, stderr)
+	proc, err = startProcessInCgroup(path, spec.Argv, spec.Env, spec.Dir, spec.Cgroup, spec.Stderr)
 
 	if err != nil {
-		fmt.Fprintf(stderr, "envdeploy: starting process failed: %s\n", err)
+		fail("starting process failed", err)
 		return
 	}
+	res.EntryPid = proc.Pid
 
 	state, err = proc.Wait()
 	if err != nil {
-		fmt.Fprintf(stderr, "envdeploy: wait on entry process: %s\n", err)
+		fmt.Fprintf(spec.Stderr, "envdeploy: wait on entry process: %s\n", err)
 		return
 	}
-	fmt.Fprintf(stderr, "envdeploy: entry process exited: %s\n", state)
+	res.EntryState = state
+	fmt.Fprintf(spec.Stderr, "envdeploy: entry process exited: %s\n", state)
 	done()
 
-	pd.loop()
+	spec.Dialer.loop()
 }
 
-func RunContainedWithDialer(id string, cmd string, env []string, dir string, cgroupDir string, stderr *os.File, pd *pinnedDialer) {
+func RunContainedWithDialer(spec *launchSpec, res *runResult) {
 	donech := make(chan interface{})
-	go runContainedWithDialerThread(id, cmd, env, dir, cgroupDir, stderr, pd, donech)
+	go runContainedWithDialerThread(spec, res, donech)
 	<-donech
 }
 
+// AdoptNetnsWithDialer runs the dialer loop in the network namespace of an
+// already running process, e.g. of a job which outlived a previous server.
+// Once the loop quits, the job's veth pair is deleted.
+func AdoptNetnsWithDialer(pid int, pd *pinnedDialer, veth vethInfo) error {
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return err
+	}
+
+	errch := make(chan error)
+	go func() {
+		/* never unlocked: the thread is discarded once the loop quits */
+		runtime.LockOSThread()
+
+		err := netns.Set(ns)
+		ns.Close()
+		errch <- err
+		if err != nil {
+			return
+		}
+
+		pd.loop()
+		deleteVeth(veth.HostIf, devNull)
+		releaseVeth(veth.HostIf)
+	}()
+	return <-errch
+}
+
 func Sh(shCmd string) string {
 	cmd := exec.Command("/bin/sh", "-c", shCmd)
 	cmd.Stdin = devNull
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const cullInterval = 30 * time.Second
+
+// cullIdleJobs periodically terminates jobs whose gateway has seen no
+// traffic for longer than the IdleTimeout of their deployable.
+func cullIdleJobs() {
+	for range time.Tick(cullInterval) {
+		var all []*job
+
+		jobs.RLock()
+		for _, j := range jobs.m {
+			all = append(all, j)
+		}
+		jobs.RUnlock()
+
+		for _, j := range all {
+			cullJob(j)
+		}
+	}
+}
+
+func cullJob(j *job) {
+	d := lookupEnv(j.Deployable)
+	if d == nil || d.IdleTimeout <= 0 {
+		return
+	}
+
+	j.Statem.RLock()
+	idle := j.Started && !j.Finished && j.StopTime.IsZero() &&
+		time.Since(j.LastActivity) >= time.Duration(d.IdleTimeout)
+	lastActivity := j.LastActivity
+	j.Statem.RUnlock()
+
+	if idle {
+		log.Printf("job %s idle since %s, stopping", j.ID, lastActivity)
+		go j.Stop()
+	}
+}
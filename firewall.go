@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	flagFirewall = flag.Bool("firewall", false, "apply the egress policies of deployables beyond keeping jobs apart: masquerading, allowed and denied destinations, and blocking services of the host unless allowed")
+)
+
+var (
+	errBadEgressProto = errors.New("egress rule protocol must be tcp or udp")
+	errBadEgressPort  = errors.New("egress rule port out of range")
+)
+
+/* egressPolicy says what a job may reach through its host veth interface; all but AllowSameOwner need -firewall */
+type egressPolicy struct {
+	/* masquerade traffic of the job leaving the host, so that it needs
+	   no routing set up for the job subnet */
+	Masquerade bool `json:"Masquerade"`
+
+	/* if non-empty, only destinations matching one of these are reachable */
+	Allow []egressRule `json:"Allow"`
+	/* destinations matching one of these are unreachable, even if allowed */
+	Deny []egressRule `json:"Deny"`
+
+	/* unless set, the job cannot connect to services of the host itself */
+	AllowHost bool `json:"AllowHost"`
+	/* traffic between jobs is dropped, unless both jobs have the same
+	   owner and this set in their deployables */
+	AllowSameOwner bool `json:"AllowSameOwner"`
+}
+
+type egressRule struct {
+	/* destination network, any if empty */
+	CIDR string `json:"CIDR"`
+	/* "tcp" or "udp", or any protocol if empty; with Ports, empty means both */
+	Proto string `json:"Proto"`
+	/* destination ports, any if empty */
+	Ports []int `json:"Ports"`
+}
+
+func (r egressRule) check() error {
+	if r.CIDR != "" {
+		_, _, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return err
+		}
+	}
+	switch r.Proto {
+	case "", "tcp", "udp":
+	default:
+		return errBadEgressProto
+	}
+	for _, port := range r.Ports {
+		if port < 1 || port > 65535 {
+			return errBadEgressPort
+		}
+	}
+	return nil
+}
+
+func (p egressPolicy) check() error {
+	for _, rules := range [][]egressRule{p.Allow, p.Deny} {
+		for _, r := range rules {
+			err := r.check()
+			if err != nil {
+				return fmt.Errorf("bad egress rule: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	fwTable = &nftables.Table{Family: nftables.TableFamilyINet, Name: "envdeploy"}
+
+	fwForward = &nftables.Chain{
+		Name: "forward", Table: fwTable,
+		Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter,
+	}
+	fwInput = &nftables.Chain{
+		Name: "input", Table: fwTable,
+		Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter,
+	}
+	fwPostrouting = &nftables.Chain{
+		Name: "postrouting", Table: fwTable,
+		Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource,
+	}
+	fwBaseChains = []*nftables.Chain{fwForward, fwInput, fwPostrouting}
+)
+
+// Per-job chains are named by the prefix and the job's host interface,
+// per-owner chains by the prefix and the owner.
+const (
+	fwEgressPrefix = "egress-"
+	fwHostPrefix   = "host-"
+	fwOwnerPrefix  = "owner-"
+)
+
+/* fwOwnerChain names the chain of owner, hashing names too long to escape */
+func fwOwnerChain(owner user) string {
+	name := fwOwnerPrefix + url.PathEscape(string(owner))
+	if len(name) >= unix.NFT_CHAIN_MAXNAMELEN {
+		sum := sha256.Sum256([]byte(owner))
+		name = fwOwnerPrefix + hex.EncodeToString(sum[:])
+	}
+	return name
+}
+
+/* fwMu serializes changes to the rules of jobs, as jobs may share owner chains */
+var fwMu sync.Mutex
+
+// initFirewall makes sure the envdeploy table and its base chains exist.
+// Rules of jobs already in the table are left alone, so that jobs outliving
+// a restart of the server stay confined; recoverJobs prunes the rest.
+func initFirewall() {
+	err := runInBackgroundNetns(func() error {
+		c, err := nftables.New()
+		if err != nil {
+			return err
+		}
+		c.AddTable(fwTable)
+		for _, ch := range fwBaseChains {
+			c.AddChain(ch)
+		}
+		return c.Flush()
+	})
+	if err != nil {
+		log.Fatalf("setting up nftables: %s", err)
+	}
+}
+
+func ifnameData(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+func matchIfname(key expr.MetaKey, name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(name)},
+	}
+}
+
+// matchJobOif matches packets going out through the veth of any job, or with
+// CmpOpNeq packets which do not.
+func matchJobOif(op expr.CmpOp) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: []byte(hostIfPrefix)},
+	}
+}
+
+func matchEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+		&expr.Bitwise{
+			SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:  binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func matchL4Proto(proto byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+/* matchDaddr matches destination addresses within ipnet */
+func matchDaddr(ipnet *net.IPNet) []expr.Any {
+	nfproto, offset, ip := byte(unix.NFPROTO_IPV6), uint32(24), ipnet.IP.To16()
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		nfproto, offset, ip = unix.NFPROTO_IPV4, 16, ip4
+	}
+	mask := net.IP(ipnet.Mask)
+	if len(mask) != len(ip) {
+		mask = mask.To16()[16-len(ip):]
+	}
+	n := uint32(len(ip))
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: n},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: n, Mask: mask, Xor: make([]byte, n)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(ipnet.Mask)},
+	}
+}
+
+/* matches expands an egress rule into the match expressions of nftables rules */
+func (r egressRule) matches() (ret [][]expr.Any) {
+	var daddr []expr.Any
+	if r.CIDR != "" {
+		_, ipnet, _ := net.ParseCIDR(r.CIDR)
+		daddr = matchDaddr(ipnet)
+	}
+
+	protos := []string{r.Proto}
+	if r.Proto == "" && len(r.Ports) > 0 {
+		protos = []string{"tcp", "udp"}
+	}
+	ports := r.Ports
+	if len(ports) == 0 {
+		ports = []int{0}
+	}
+
+	for _, proto := range protos {
+		for _, port := range ports {
+			m := append([]expr.Any{}, daddr...)
+			switch proto {
+			case "tcp":
+				m = append(m, matchL4Proto(unix.IPPROTO_TCP)...)
+			case "udp":
+				m = append(m, matchL4Proto(unix.IPPROTO_UDP)...)
+			}
+			if port != 0 {
+				m = append(m,
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+				)
+			}
+			ret = append(ret, m)
+		}
+	}
+	return
+}
+
+func verdict(kind expr.VerdictKind) *expr.Verdict {
+	return &expr.Verdict{Kind: kind}
+}
+
+func jump(chain string) *expr.Verdict {
+	return &expr.Verdict{Kind: expr.VerdictJump, Chain: chain}
+}
+
+func concatExprs(parts ...[]expr.Any) (ret []expr.Any) {
+	for _, p := range parts {
+		ret = append(ret, p...)
+	}
+	return
+}
+
+/* installJobFirewall confines traffic from hostIf, marking rules outside the job's chains with hostIf */
+func installJobFirewall(hostIf string, owner user, policy egressPolicy) error {
+	fwMu.Lock()
+	defer fwMu.Unlock()
+
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	comment := userdata.AppendString(nil, userdata.TypeComment, hostIf)
+	addRule := func(chain *nftables.Chain, exprs ...[]expr.Any) {
+		c.AddRule(&nftables.Rule{Table: fwTable, Chain: chain, Exprs: concatExprs(exprs...), UserData: comment})
+	}
+
+	egress := c.AddChain(&nftables.Chain{Name: fwEgressPrefix + hostIf, Table: fwTable})
+	addRule(egress, matchEstablished(), []expr.Any{verdict(expr.VerdictAccept)})
+	if policy.AllowSameOwner {
+		/* shared by the owner's jobs, accepting packets to the veth of any of them */
+		peers := c.AddChain(&nftables.Chain{Name: fwOwnerChain(owner), Table: fwTable})
+		addRule(peers, matchIfname(expr.MetaKeyOIFNAME, hostIf), []expr.Any{verdict(expr.VerdictAccept)})
+		addRule(egress, matchJobOif(expr.CmpOpEq), []expr.Any{jump(peers.Name)})
+	}
+	addRule(egress, matchJobOif(expr.CmpOpEq), []expr.Any{verdict(expr.VerdictDrop)})
+	addRule(fwForward, matchIfname(expr.MetaKeyIIFNAME, hostIf), []expr.Any{jump(egress.Name)})
+	/* jobs are kept apart in any case, their egress policies only apply with -firewall */
+	if !*flagFirewall {
+		return c.Flush()
+	}
+
+	for _, r := range policy.Deny {
+		for _, m := range r.matches() {
+			addRule(egress, m, []expr.Any{verdict(expr.VerdictDrop)})
+		}
+	}
+	if len(policy.Allow) > 0 {
+		for _, r := range policy.Allow {
+			for _, m := range r.matches() {
+				addRule(egress, m, []expr.Any{verdict(expr.VerdictAccept)})
+			}
+		}
+		addRule(egress, []expr.Any{verdict(expr.VerdictDrop)})
+	}
+
+	if !policy.AllowHost {
+		/* ICMP stays allowed, IPv6 neighbour discovery depends on it */
+		host := c.AddChain(&nftables.Chain{Name: fwHostPrefix + hostIf, Table: fwTable})
+		addRule(host, matchEstablished(), []expr.Any{verdict(expr.VerdictAccept)})
+		addRule(host, matchL4Proto(unix.IPPROTO_ICMP), []expr.Any{verdict(expr.VerdictAccept)})
+		addRule(host, matchL4Proto(unix.IPPROTO_ICMPV6), []expr.Any{verdict(expr.VerdictAccept)})
+		addRule(host, []expr.Any{verdict(expr.VerdictDrop)})
+		addRule(fwInput, matchIfname(expr.MetaKeyIIFNAME, hostIf), []expr.Any{jump(host.Name)})
+	}
+
+	if policy.Masquerade {
+		addRule(fwPostrouting, matchIfname(expr.MetaKeyIIFNAME, hostIf), matchJobOif(expr.CmpOpNeq), []expr.Any{&expr.Masq{}})
+	}
+
+	return c.Flush()
+}
+
+/* removeJobFirewall deletes whatever installJobFirewall put in place for hostIf */
+func removeJobFirewall(hostIf string) error {
+	fwMu.Lock()
+	defer fwMu.Unlock()
+
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	chains, err := c.ListChainsOfTableFamily(fwTable.Family)
+	if err != nil {
+		return err
+	}
+
+	/* owner chains left empty go last, the job's chain may jump to them */
+	var emptied []*nftables.Chain
+	for _, ch := range chains {
+		if ch.Table.Name != fwTable.Name {
+			continue
+		}
+		if ch.Name == fwEgressPrefix+hostIf || ch.Name == fwHostPrefix+hostIf {
+			c.FlushChain(ch)
+			c.DelChain(ch)
+			continue
+		}
+
+		rules, err := c.GetRules(fwTable, ch)
+		if err != nil {
+			return err
+		}
+		left := len(rules)
+		for _, r := range rules {
+			if s, _ := userdata.GetString(r.UserData, userdata.TypeComment); s == hostIf {
+				c.DelRule(r)
+				left--
+			}
+		}
+		if left == 0 && len(rules) > 0 && strings.HasPrefix(ch.Name, fwOwnerPrefix) {
+			emptied = append(emptied, ch)
+		}
+	}
+	for _, ch := range emptied {
+		c.DelChain(ch)
+	}
+	return c.Flush()
+}
+
+/* firewalledHostIfs lists the host interfaces which have rules installed */
+func firewalledHostIfs() (ret []string, err error) {
+	c, err := nftables.New()
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, base := range fwBaseChains {
+		rules, err := c.GetRules(fwTable, base)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			s, ok := userdata.GetString(r.UserData, userdata.TypeComment)
+			if ok && strings.HasPrefix(s, hostIfPrefix) && !seen[s] {
+				seen[s] = true
+				ret = append(ret, s)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	flagJobSubnet  = flag.String("job_subnet", "10.0.0.0/16", "subnet to carve veth address pairs of jobs from, IPv4 or IPv6")
+	flagJobSubnet6 = flag.String("job_subnet6", "", "IPv6 subnet to carve additional veth address pairs from, for dual-stack jobs")
+)
+
+var (
+	errAddrPoolExhausted = errors.New("no free network addresses for another job")
+	errAddrNotInPool     = errors.New("interface not from the address pool")
+)
+
+/* interface names have to fit in IFNAMSIZ along with the terminating null */
+const maxHostIfNameLen = 15
+
+/* addrPool hands out host interface names along with /31 or /127 address pairs */
+type addrPool struct {
+	sync.Mutex
+
+	subnet    *net.IPNet
+	prefixLen int
+	size      int
+
+	used map[int]bool
+	/* allocation goes round the pool so that pairs aren't reused right away */
+	next int
+}
+
+var (
+	jobAddrs *addrPool
+	/* nil unless jobs are dual-stack, pairs are then taken at the same index as in jobAddrs */
+	jobAddrs6 *addrPool
+)
+
+func initAddrPools() {
+	var err error
+	jobAddrs, err = newAddrPool(*flagJobSubnet)
+	if err != nil {
+		log.Fatalf("bad job subnet: %s", err)
+	}
+	if *flagJobSubnet6 == "" {
+		return
+	}
+
+	jobAddrs6, err = newAddrPool(*flagJobSubnet6)
+	if err == nil && (jobAddrs6.subnet.IP.To4() != nil || jobAddrs.subnet.IP.To4() == nil) {
+		err = errors.New("dual-stack needs an IPv4 job subnet and an IPv6 one")
+	}
+	if err != nil {
+		log.Fatalf("bad IPv6 job subnet: %s", err)
+	}
+	if jobAddrs6.size < jobAddrs.size {
+		jobAddrs.size = jobAddrs6.size
+	}
+}
+
+func newAddrPool(cidr string) (*addrPool, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := subnet.Mask.Size()
+	pairBits := bits - ones - 1
+	if pairBits < 0 {
+		return nil, fmt.Errorf("subnet %s too small", cidr)
+	}
+
+	size := 1
+	for i := len(hostIfPrefix); i < maxHostIfNameLen; i++ {
+		size *= 10
+	}
+	if pairBits < 31 && 1<<uint(pairBits) < size {
+		size = 1 << uint(pairBits)
+	}
+
+	return &addrPool{
+		subnet:    subnet,
+		prefixLen: bits - 1,
+		size:      size,
+		used:      make(map[int]bool),
+	}, nil
+}
+
+/* addToIP returns ip offset by n */
+func addToIP(ip net.IP, n int) net.IP {
+	ret := make(net.IP, len(ip))
+	copy(ret, ip)
+	carry := n
+	for i := len(ret) - 1; i >= 0 && carry > 0; i-- {
+		sum := int(ret[i]) + carry
+		ret[i] = byte(sum)
+		carry = sum >> 8
+	}
+	return ret
+}
+
+func (p *addrPool) pairAt(index int) vethInfo {
+	base := p.subnet.IP
+	if v4 := base.To4(); v4 != nil {
+		base = v4
+	}
+	return vethInfo{
+		HostIf:    hostIfPrefix + strconv.Itoa(index),
+		HostIP:    addToIP(base, 2*index).String(),
+		GuestIP:   addToIP(base, 2*index+1).String(),
+		PrefixLen: p.prefixLen,
+	}
+}
+
+func (p *addrPool) alloc() (vethInfo, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	for i := 0; i < p.size; i++ {
+		index := (p.next + i) % p.size
+		if !p.used[index] {
+			p.used[index] = true
+			p.next = index + 1
+			return p.pairAt(index), nil
+		}
+	}
+	return vethInfo{}, errAddrPoolExhausted
+}
+
+func (p *addrPool) indexOf(hostIf string) (int, error) {
+	index, err := strconv.Atoi(strings.TrimPrefix(hostIf, hostIfPrefix))
+	if err != nil || !strings.HasPrefix(hostIf, hostIfPrefix) || index < 0 || index >= p.size {
+		return 0, errAddrNotInPool
+	}
+	return index, nil
+}
+
+/* reserve marks the pair of hostIf used, e.g. by a job recovered at start-up */
+func (p *addrPool) reserve(hostIf string) (vethInfo, error) {
+	index, err := p.indexOf(hostIf)
+	if err != nil {
+		return vethInfo{}, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.used[index] = true
+	return p.pairAt(index), nil
+}
+
+func (p *addrPool) release(hostIf string) {
+	index, err := p.indexOf(hostIf)
+	if err != nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	delete(p.used, index)
+}
+
+/* allocVeth picks the name and addresses for the veth pair of a new job */
+func allocVeth() (vethInfo, error) {
+	veth, err := jobAddrs.alloc()
+	if err != nil || jobAddrs6 == nil {
+		return veth, err
+	}
+
+	veth6, err := jobAddrs6.reserve(veth.HostIf)
+	if err != nil {
+		jobAddrs.release(veth.HostIf)
+		return vethInfo{}, err
+	}
+	veth.HostIP6, veth.GuestIP6, veth.PrefixLen6 = veth6.HostIP, veth6.GuestIP, veth6.PrefixLen
+	return veth, nil
+}
+
+/* reserveVeth re-reserves the pair of a job recovered at start-up */
+func reserveVeth(hostIf string) (vethInfo, error) {
+	veth, err := jobAddrs.reserve(hostIf)
+	if err != nil || jobAddrs6 == nil {
+		return veth, err
+	}
+
+	veth6, err := jobAddrs6.reserve(hostIf)
+	if err != nil {
+		jobAddrs.release(hostIf)
+		return vethInfo{}, err
+	}
+	veth.HostIP6, veth.GuestIP6, veth.PrefixLen6 = veth6.HostIP, veth6.GuestIP, veth6.PrefixLen
+	return veth, nil
+}
+
+func releaseVeth(hostIf string) {
+	jobAddrs.release(hostIf)
+	if jobAddrs6 != nil {
+		jobAddrs6.release(hostIf)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestNewAddrPool(t *testing.T) {
+	tests := []struct {
+		cidr      string
+		size      int
+		prefixLen int
+		err       bool
+	}{
+		{"10.0.0.0/16", 1000, 31, false},
+		{"10.0.0.0/29", 4, 31, false},
+		{"10.0.0.0/31", 1, 31, false},
+		{"10.0.0.0/32", 0, 0, true},
+		{"fd00::/64", 1000, 127, false},
+		{"fd00::/126", 2, 127, false},
+		{"fd00::/127", 1, 127, false},
+		{"fd00::/128", 0, 0, true},
+		{"not a subnet", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		p, err := newAddrPool(tt.cidr)
+		if tt.err {
+			if err == nil {
+				t.Errorf("newAddrPool(%q) succeeded, want error", tt.cidr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newAddrPool(%q): %s", tt.cidr, err)
+			continue
+		}
+		if p.size != tt.size || p.prefixLen != tt.prefixLen {
+			t.Errorf("newAddrPool(%q) has size %d, prefix length %d; want %d, %d", tt.cidr, p.size, p.prefixLen, tt.size, tt.prefixLen)
+		}
+	}
+}
+
+func TestAddrPoolAlloc(t *testing.T) {
+	tests := []struct {
+		cidr  string
+		pairs []vethInfo
+	}{
+		{"10.0.0.0/29", []vethInfo{
+			{hostIfPrefix + "0", "10.0.0.0", "10.0.0.1", 31, "", "", 0},
+			{hostIfPrefix + "1", "10.0.0.2", "10.0.0.3", 31, "", "", 0},
+			{hostIfPrefix + "2", "10.0.0.4", "10.0.0.5", 31, "", "", 0},
+			{hostIfPrefix + "3", "10.0.0.6", "10.0.0.7", 31, "", "", 0},
+		}},
+		{"10.0.1.0/31", []vethInfo{
+			{hostIfPrefix + "0", "10.0.1.0", "10.0.1.1", 31, "", "", 0},
+		}},
+		{"fd00::100/126", []vethInfo{
+			{hostIfPrefix + "0", "fd00::100", "fd00::101", 127, "", "", 0},
+			{hostIfPrefix + "1", "fd00::102", "fd00::103", 127, "", "", 0},
+		}},
+		{"fd00::/127", []vethInfo{
+			{hostIfPrefix + "0", "fd00::", "fd00::1", 127, "", "", 0},
+		}},
+	}
+
+	for _, tt := range tests {
+		p, err := newAddrPool(tt.cidr)
+		if err != nil {
+			t.Fatalf("newAddrPool(%q): %s", tt.cidr, err)
+		}
+		for _, want := range tt.pairs {
+			veth, err := p.alloc()
+			if err != nil || veth != want {
+				t.Errorf("%s: alloc() = %+v, %v; want %+v", tt.cidr, veth, err, want)
+			}
+		}
+		if veth, err := p.alloc(); err != errAddrPoolExhausted {
+			t.Errorf("%s: alloc() on exhausted pool = %+v, %v; want %v", tt.cidr, veth, err, errAddrPoolExhausted)
+		}
+	}
+}
+
+func TestAddrPoolRelease(t *testing.T) {
+	p, err := newAddrPool("10.0.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < p.size; i++ {
+		if _, err := p.alloc(); err != nil {
+			t.Fatalf("alloc() #%d: %s", i, err)
+		}
+	}
+
+	/* releasing something not from the pool changes nothing */
+	p.release("eth0")
+	p.release(hostIfPrefix + "4")
+	if _, err := p.alloc(); err != errAddrPoolExhausted {
+		t.Fatalf("alloc() = %v, want %v", err, errAddrPoolExhausted)
+	}
+
+	p.release(hostIfPrefix + "2")
+	veth, err := p.alloc()
+	if err != nil || veth.HostIf != hostIfPrefix+"2" || veth.HostIP != "10.0.0.4" {
+		t.Fatalf("alloc() after release = %+v, %v; want the released pair", veth, err)
+	}
+
+	/* with several pairs free, allocation carries on past the last one handed out */
+	p.release(hostIfPrefix + "0")
+	p.release(hostIfPrefix + "3")
+	veth, err = p.alloc()
+	if err != nil || veth.HostIf != hostIfPrefix+"3" {
+		t.Fatalf("alloc() = %+v, %v; want %s", veth, err, hostIfPrefix+"3")
+	}
+	veth, err = p.alloc()
+	if err != nil || veth.HostIf != hostIfPrefix+"0" {
+		t.Fatalf("alloc() = %+v, %v; want %s", veth, err, hostIfPrefix+"0")
+	}
+}
+
+func TestAddrPoolReserve(t *testing.T) {
+	p, err := newAddrPool("10.0.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"eth0", hostIfPrefix, hostIfPrefix + "x", hostIfPrefix + "-1", hostIfPrefix + "4"} {
+		if _, err := p.reserve(name); err != errAddrNotInPool {
+			t.Errorf("reserve(%q) = %v, want %v", name, err, errAddrNotInPool)
+		}
+	}
+
+	veth, err := p.reserve(hostIfPrefix + "0")
+	if err != nil || veth.GuestIP != "10.0.0.1" {
+		t.Fatalf("reserve() = %+v, %v", veth, err)
+	}
+	veth, err = p.alloc()
+	if err != nil || veth.HostIf != hostIfPrefix+"1" {
+		t.Fatalf("alloc() = %+v, %v; want %s", veth, err, hostIfPrefix+"1")
+	}
+}
+
+func TestAddrPoolConcurrentAlloc(t *testing.T) {
+	p, err := newAddrPool("10.0.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 10
+	var wg sync.WaitGroup
+	results := make([][]vethInfo, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for {
+				veth, err := p.alloc()
+				if err != nil {
+					return
+				}
+				results[w] = append(results[w], veth)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, r := range results {
+		for _, veth := range r {
+			if seen[veth.HostIf] || seen[veth.HostIP] {
+				t.Fatalf("pair %+v handed out twice", veth)
+			}
+			seen[veth.HostIf], seen[veth.HostIP] = true, true
+		}
+	}
+	if len(seen) != 2*p.size {
+		t.Errorf("allocated %d pairs, want %d", len(seen)/2, p.size)
+	}
+	if _, err := p.alloc(); err != errAddrPoolExhausted {
+		t.Errorf("alloc() = %v, want %v", err, errAddrPoolExhausted)
+	}
+}
+
+func TestAllocVethDualStack(t *testing.T) {
+	defer func(v4, v6 *addrPool) { jobAddrs, jobAddrs6 = v4, v6 }(jobAddrs, jobAddrs6)
+
+	var err error
+	jobAddrs, err = newAddrPool("10.0.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobAddrs6, err = newAddrPool("fd00::/126")
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* as in initAddrPools, the smaller pool bounds both */
+	jobAddrs.size = jobAddrs6.size
+
+	for i := 0; i < 2; i++ {
+		veth, err := allocVeth()
+		want := vethInfo{
+			hostIfPrefix + fmt.Sprint(i), fmt.Sprintf("10.0.0.%d", 2*i), fmt.Sprintf("10.0.0.%d", 2*i+1), 31,
+			fmt.Sprintf("fd00::%d", 2*i), fmt.Sprintf("fd00::%d", 2*i+1), 127,
+		}
+		if i == 0 {
+			want.HostIP6 = "fd00::"
+		}
+		if err != nil || veth != want {
+			t.Errorf("allocVeth() = %+v, %v; want %+v", veth, err, want)
+		}
+	}
+	if _, err := allocVeth(); err != errAddrPoolExhausted {
+		t.Errorf("allocVeth() = %v, want %v", err, errAddrPoolExhausted)
+	}
+
+	releaseVeth(hostIfPrefix + "1")
+	veth, err := reserveVeth(hostIfPrefix + "1")
+	if err != nil || veth.GuestIP6 != "fd00::3" {
+		t.Errorf("reserveVeth() = %+v, %v", veth, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,15 +9,23 @@ import (
 	"os"
 	"path"
 	"sync"
+	"syscall"
 	"time"
 )
 
+var (
+	flagStopGrace = flag.Duration("stop_grace", 30*time.Second, "time given to a job to exit after SIGTERM before all of its processes are killed")
+)
+
 type job struct {
 	ID     string
 	Cgroup string
 
-	Owner  user
-	Public bool
+	Owner      user
+	Deployable string
+	Params     map[string]string
+	Profile    string
+	Public     bool
 
 	http.RoundTripper
 	*httputil.ReverseProxy
@@ -24,13 +33,36 @@ type job struct {
 	Stderr   *os.File
 	StderrFn string
 
-	Dialer *pinnedDialer
+	Dialer   *pinnedDialer
+	Upstream upstreamConfig
+
+	HostIf     string
+	HostIP     string
+	GuestIP    string
+	PrefixLen  int
+	HostIP6    string
+	GuestIP6   string
+	PrefixLen6 int
+	Bandwidth  bandwidthLimits
 
 	Statem     sync.RWMutex
+	Savem      sync.Mutex
+	Removed    bool
 	Started    bool
 	StartTime  time.Time
 	Finished   bool
 	FinishTime time.Time
+	Ready      bool
+
+	EntryPid    int
+	EntryExited bool
+	ExitCode    int
+	ExitSignal  string
+	Outcome     string
+	FailReason  string
+
+	LastActivity time.Time
+	StopTime     time.Time
 }
 
 type jobsMap struct {
@@ -40,11 +72,30 @@ type jobsMap struct {
 
 var jobs jobsMap = jobsMap{m: make(map[string]*job)}
 
-func initJob(id string, owner user) (*job, error) {
-	var err error
+func initJob(id string, owner user, d *Deployable, params map[string]string, profile *resourceProfile) (ret *job, err error) {
+	veth, err := allocVeth()
+	if err != nil {
+		return nil, err
+	}
+	/* until the job gets started, the lease is ours to give back */
+	defer func() {
+		if err != nil {
+			releaseVeth(veth.HostIf)
+		}
+	}()
 
-	cgroupPath := path.Join(cgroupJobsPath, id)
-	createCgroup(cgroupPath)
+	cgroupPath, err := createJobCgroup(owner, id)
+	if err != nil {
+		return nil, err
+	}
+	err = d.Limits.apply(cgroupPath)
+	if err == nil && profile != nil {
+		err = profile.Limits.apply(cgroupPath)
+	}
+	if err != nil {
+		removeJobCgroup(cgroupPath)
+		return nil, err
+	}
 
 	logDir := *flagLogDir
 	err = os.MkdirAll(logDir, 0750)
@@ -60,49 +111,74 @@ func initJob(id string, owner user) (*job, error) {
 		return nil, err
 	}
 
+	up := d.Upstream
+	if up.Socket != "" {
+		dir, err := createSocketDir(id, owner)
+		if err != nil {
+			stderr.Close()
+			removeJobCgroup(cgroupPath)
+			return nil, err
+		}
+		up.Socket = path.Join(dir, up.Socket)
+	}
+
+	j := newJob(id, owner, cgroupPath, stderr, stderrFn, up)
+	j.Deployable = d.ID
+	j.setVeth(veth)
+	j.Bandwidth = d.Bandwidth
+	j.Params = params
+	if profile != nil {
+		j.Profile = profile.ID
+	}
+	j.Public = d.Public
+	return j, nil
+}
+
+func newJob(id string, owner user, cgroupPath string, stderr *os.File, stderrFn string, up upstreamConfig) *job {
 	pd := CreatePinnedDialer()
 
-	rt := &http.Transport{
-		Dial:                pd.Dial,
-		MaxIdleConns:        24,
-		IdleConnTimeout:     1 * time.Hour,
-		TLSHandshakeTimeout: 10 * time.Second,
-		DisableCompression:  true,
-	}
-
-	return &job{
-		ID:           id,
-		Cgroup:       cgroupPath,
-		Owner:        owner,
-		Dialer:       pd,
-		Stderr:       stderr,
-		StderrFn:     stderrFn,
-		RoundTripper: rt,
-		ReverseProxy: &httputil.ReverseProxy{
-			Director: func(req *http.Request) {
-				req.URL.Path = *flagBasePath + req.URL.Path
-				req.URL.Scheme = "http"
-				req.URL.Host = "127.0.0.1:8000"
-			},
-			Transport: rt,
-		},
-	}, nil
-}
-
-func (jobs *jobsMap) CreateJob(id string, owner user) (ret *job, err error) {
+	j := &job{
+		ID:       id,
+		Cgroup:   cgroupPath,
+		Owner:    owner,
+		Dialer:   pd,
+		Upstream: up.withDefaults(),
+		Stderr:   stderr,
+		StderrFn: stderrFn,
+	}
+	j.RoundTripper = newUpstreamTransport(up, pd, j.touch)
+	j.ReverseProxy = &httputil.ReverseProxy{
+		Director:  upstreamDirector(up, id),
+		Transport: j.RoundTripper,
+	}
+	j.ReverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		serveGatewayError(w, r, j, err)
+	}
+	return j
+}
+
+func (jobs *jobsMap) CreateJob(id string, owner user, d *Deployable, params map[string]string, profile *resourceProfile) (ret *job, err error) {
 	jobs.Lock()
 	defer jobs.Unlock()
 
+	if !reJobID.MatchString(id) {
+		return nil, errBadJobID
+	}
 	if _, ok := jobs.m[id]; ok {
 		return nil, errJobExists
 	}
+	err = jobs.checkQuota(owner, d)
+	if err != nil {
+		return nil, err
+	}
 
-	ret, err = initJob(id, owner)
+	ret, err = initJob(id, owner, d, params, profile)
 	if err != nil {
 		return
 	}
 
 	jobs.m[id] = ret
+	ret.save()
 	return
 }
 
@@ -114,8 +190,8 @@ func (jobs *jobsMap) Lookup(id string) (ret *job) {
 }
 
 func (jobs *jobsMap) Remove(id string) error {
-	jobs.RLock()
-	defer jobs.RUnlock()
+	jobs.Lock()
+	defer jobs.Unlock()
 	job, ok := jobs.m[id]
 	if !ok {
 		return errJobNotFound
@@ -124,37 +200,166 @@ func (jobs *jobsMap) Remove(id string) error {
 		return errJobNotFinished
 	}
 	delete(jobs.m, id)
+	job.Savem.Lock()
+	job.Removed = true
+	discardJobRecord(id)
+	job.Savem.Unlock()
+	forgetJobMetrics(id)
 	return nil
 }
 
-func (j *job) Start(cmd string, env []string, dir string) {
+// Start launches the job's entry process. An error returned is either
+// errJobStarted, or a *startError in which case the job has been marked
+// failed and its resources released.
+func (j *job) Start(argv []string, env []string, dir string, readiness *readinessProbe, egress egressPolicy) error {
 	j.Statem.Lock()
 	if j.Started {
 		log.Printf("attempt to start already started job %s", j.ID)
 		j.Statem.Unlock()
-		return
+		return errJobStarted
 	}
 	j.Started = true
 	j.StartTime = time.Now()
+	j.LastActivity = j.StartTime
 	j.Statem.Unlock()
+	jobsStarted.WithLabelValues(j.Deployable).Inc()
 
-	RunContainedWithDialer(j.ID, cmd, env, dir, j.Cgroup, j.Stderr, j.Dialer)
+	var res runResult
+	RunContainedWithDialer(&launchSpec{
+		Owner:     j.Owner,
+		Argv:      argv,
+		Env:       env,
+		Dir:       dir,
+		Cgroup:    j.Cgroup,
+		Stderr:    j.Stderr,
+		Dialer:    j.Dialer,
+		Veth:      j.veth(),
+		Egress:    egress,
+		Bandwidth: j.Bandwidth,
+	}, &res)
 
-	/* wait for the job to get unpopulated, then Quit the pinnedDialer */
-	go func() {
-		<-waitForCgroupUnpopulated(j.Cgroup)
+	j.Statem.Lock()
+	j.EntryPid = res.EntryPid
+	if res.EntryState != nil {
+		j.EntryExited = true
+		j.ExitCode = res.EntryState.ExitCode()
+		if ws, ok := res.EntryState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			j.ExitSignal = ws.Signal().String()
+		}
+	}
+	if res.StartErr != nil {
+		j.FailReason = res.StartErr.Error()
+	}
+	j.Statem.Unlock()
 
-		j.Statem.Lock()
-		j.Finished = true
-		j.FinishTime = time.Now()
-		j.Statem.Unlock()
+	if res.StartErr != nil {
+		j.finish()
+		return res.StartErr
+	}
+
+	j.Statem.Lock()
+	j.Ready = readiness == nil
+	j.Statem.Unlock()
+	j.save()
+
+	go j.watchFinish()
+	if readiness != nil {
+		go j.awaitReady(readiness)
+	}
+	return nil
+}
+
+func (j *job) veth() vethInfo {
+	return vethInfo{j.HostIf, j.HostIP, j.GuestIP, j.PrefixLen, j.HostIP6, j.GuestIP6, j.PrefixLen6}
+}
+
+func (j *job) setVeth(veth vethInfo) {
+	j.HostIf, j.HostIP, j.GuestIP, j.PrefixLen = veth.HostIf, veth.HostIP, veth.GuestIP, veth.PrefixLen
+	j.HostIP6, j.GuestIP6, j.PrefixLen6 = veth.HostIP6, veth.GuestIP6, veth.PrefixLen6
+}
 
-		j.Dialer.Quit()
-		err_str := Sh(fmt.Sprintf("rmdir %s", j.Cgroup))
-		if err_str != "" {
-			log.Println(err_str)
+/* wait for the job to get unpopulated, then finish it */
+func (j *job) watchFinish() {
+	<-waitForCgroupUnpopulated(j.Cgroup)
+	j.finish()
+}
+
+/* finish marks the job finished, Quits the pinnedDialer and removes the cgroup */
+func (j *job) finish() {
+	j.Statem.Lock()
+	j.Finished = true
+	j.FinishTime = time.Now()
+	j.Outcome = j.outcome()
+	j.Statem.Unlock()
+	j.save()
+	jobsFinished.WithLabelValues(j.Deployable).Inc()
+
+	j.Dialer.Quit()
+	err := removeJobCgroup(j.Cgroup)
+	if err != nil {
+		log.Printf("removing cgroup of job %s: %s", j.ID, err)
+	}
+	if j.Upstream.Socket != "" {
+		err = removeSocketDir(j.ID)
+		if err != nil {
+			log.Printf("removing socket directory of job %s: %s", j.ID, err)
 		}
-	}()
+	}
+}
+
+const (
+	outcomeSucceeded     = "succeeded"
+	outcomeFailed        = "failed"
+	outcomeKilled        = "killed"
+	outcomeFailedToStart = "failed-to-start"
+)
+
+/* outcome judges how a finished job went; Statem must be held */
+func (j *job) outcome() string {
+	switch {
+	case j.EntryPid == 0:
+		return outcomeFailedToStart
+	case j.FailReason != "":
+		return outcomeFailed
+	case !j.StopTime.IsZero() || j.ExitSignal != "":
+		return outcomeKilled
+	case !j.EntryExited || j.ExitCode != 0:
+		return outcomeFailed
+	default:
+		return outcomeSucceeded
+	}
+}
+
+/* ExitDescription describes how the entry process exited, if it did */
+func (j *job) ExitDescription() string {
+	j.Statem.RLock()
+	defer j.Statem.RUnlock()
+
+	switch {
+	case !j.EntryExited:
+		return ""
+	case j.ExitSignal != "":
+		return "terminated by " + j.ExitSignal
+	default:
+		return fmt.Sprintf("exit code %d", j.ExitCode)
+	}
+}
+
+/* State summarizes the job's lifecycle for display and metrics */
+func (j *job) State() string {
+	j.Statem.RLock()
+	defer j.Statem.RUnlock()
+
+	switch {
+	case j.Finished:
+		return j.Outcome
+	case j.Started && !j.Ready:
+		return "starting"
+	case j.Started:
+		return "running"
+	default:
+		return "created"
+	}
 }
 
 func (j *job) IsFinished() bool {
@@ -163,10 +368,75 @@ func (j *job) IsFinished() bool {
 	return j.Finished
 }
 
-func (j *job) SendSignal(sig int) {
-	/* IMPROVE */
-	err_str := Sh(fmt.Sprintf("kill -s %d $(find %s -name cgroup.procs | xargs cat | sort -n | head -n 1)", sig, j.Cgroup))
-	if err_str != "" {
-		log.Println(err_str)
+/* SendSignal signals the entry process, or every process of the job once that has exited */
+func (j *job) SendSignal(sig syscall.Signal) error {
+	pids := cgroupMemberPids(j.Cgroup)
+	if len(pids) == 0 {
+		return errJobNotRunning
+	}
+
+	j.Statem.RLock()
+	entryPid, entryExited := j.EntryPid, j.EntryExited
+	j.Statem.RUnlock()
+
+	for _, p := range pids {
+		if p == entryPid && !entryExited {
+			return syscall.Kill(p, sig)
+		}
+	}
+
+	var ret error
+	for _, p := range pids {
+		err := syscall.Kill(p, sig)
+		if err != nil && err != syscall.ESRCH && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+/* Stop sends the job SIGTERM, kills whatever is left after the grace period and waits for it to finish */
+func (j *job) Stop() {
+	j.Statem.Lock()
+	if !j.Started || j.Finished || !j.StopTime.IsZero() {
+		j.Statem.Unlock()
+		return
+	}
+	j.StopTime = time.Now()
+	j.Statem.Unlock()
+
+	unpopulated := waitForCgroupUnpopulated(j.Cgroup)
+
+	err := j.SendSignal(syscall.SIGTERM)
+	if err != nil && err != errJobNotRunning {
+		log.Printf("stopping job %s: %s", j.ID, err)
+	}
+
+	select {
+	case <-unpopulated:
+		return
+	case <-time.After(*flagStopGrace):
+	}
+
+	log.Printf("job %s did not exit within %s, killing", j.ID, *flagStopGrace)
+	killCgroup(j.Cgroup)
+	<-unpopulated
+}
+
+// touch records activity on the job's gateway. It is called as requests
+// come and go, and as data flows over upstream connections, so that e.g. a
+// websocket counts as activity only while it is in use.
+func (j *job) touch() {
+	j.Statem.Lock()
+	defer j.Statem.Unlock()
+	j.LastActivity = time.Now()
+}
+
+/* Usage returns the job's current resource usage, or nil once its cgroup is gone */
+func (j *job) Usage() *cgroupUsage {
+	u, err := readCgroupUsage(j.Cgroup)
+	if err != nil {
+		return nil
 	}
+	return u
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	osuser "os/user"
+	"sort"
+	"strings"
+	plainTmpl "text/template"
+)
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+var (
+	errUnterminatedQuote = errors.New("unterminated quote in launch script")
+	errNoCommand         = errors.New("no command to run")
+)
+
+// splitShellWords splits s into words the way a shell would, honouring
+// single and double quotes and backslash escapes. No expansion of any kind
+// is done.
+func splitShellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			inWord = true
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errUnterminatedQuote
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, errUnterminatedQuote
+				}
+				if s[i] == '"' {
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\\\"$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+/* argv is the command line to launch, from Args if given or else from LaunchScript */
+func (d *Deployable) argv() ([]string, error) {
+	argv := d.Args
+	if len(argv) == 0 {
+		var err error
+		argv, err = splitShellWords(d.LaunchScript)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(argv) == 0 {
+		return nil, errNoCommand
+	}
+	return argv, nil
+}
+
+/* launchContext is what templates in a deployable's launch settings can refer to */
+type launchContext struct {
+	ID         string
+	Owner      string
+	Deployable string
+}
+
+/* workDir expands the WorkDir template, defaulting to / */
+func (d *Deployable) workDir(ctx launchContext) (string, error) {
+	if d.WorkDir == "" {
+		return "/", nil
+	}
+
+	t, err := plainTmpl.New("workdir").Option("missingkey=error").Parse(d.WorkDir)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, ctx)
+	return buf.String(), err
+}
+
+// environ builds the environment of job's entry process from scratch. Host
+// variables only get through if listed in PassEnv, the deployable's Env
+// comes on top, and variables describing the job cannot be overridden.
+func (d *Deployable) environ(j *job) []string {
+	vars := map[string]string{
+		"PATH": defaultPath,
+		"HOME": "/",
+	}
+	if sysUser, err := osuser.Lookup(string(j.Owner)); err == nil {
+		vars["HOME"] = sysUser.HomeDir
+	}
+
+	for _, name := range d.PassEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			vars[name] = v
+		}
+	}
+	for name, v := range d.Env {
+		vars[name] = v
+	}
+	for _, p := range d.Params {
+		if v, ok := j.Params[p.Name]; ok {
+			vars[p.EnvName()] = v
+		}
+	}
+
+	vars["WEB_BASE_PATH"] = *flagBasePath + "/enter/" + j.ID
+	vars["WEB_HOST"] = j.Upstream.Host()
+	vars["WEB_PORT"] = j.Upstream.Port()
+	if j.Upstream.Socket != "" {
+		vars["WEB_SOCKET"] = j.Upstream.Socket
+	}
+	vars["JOB_ID"] = j.ID
+	vars["JOB_OWNER"] = string(j.Owner)
+	vars["JOB_DEPLOYABLE"] = d.ID
+	vars["JOB_GATEWAY_URL"] = Link("/enter/" + j.ID + "/")
+
+	ret := make([]string, 0, len(vars))
+	for name, v := range vars {
+		ret = append(ret, name+"="+v)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		in    string
+		words []string
+		err   error
+	}{
+		{"", nil, nil},
+		{" \t\n", nil, nil},
+		{"a", []string{"a"}, nil},
+		{"  a\tb\nc  ", []string{"a", "b", "c"}, nil},
+		{`'a b' c`, []string{"a b", "c"}, nil},
+		{`"a b" c`, []string{"a b", "c"}, nil},
+		{`a'b c'd`, []string{"ab cd"}, nil},
+		{`''`, []string{""}, nil},
+		{`"" ''`, []string{"", ""}, nil},
+		{`'a\b'`, []string{`a\b`}, nil},
+		{`'a"b'`, []string{`a"b`}, nil},
+		{`"a'b"`, []string{`a'b`}, nil},
+		{`"a\"b"`, []string{`a"b`}, nil},
+		{`"a\\b"`, []string{`a\b`}, nil},
+		{`"a\$b\` + "`" + `"`, []string{"a$b`"}, nil},
+		{`"a\nb"`, []string{`a\nb`}, nil},
+		{`"$HOME"`, []string{"$HOME"}, nil},
+		{`a\ b`, []string{"a b"}, nil},
+		{`\'a\"`, []string{`'a"`}, nil},
+		{`\\`, []string{`\`}, nil},
+		{`a\`, []string{"a"}, nil},
+		{`'a`, nil, errUnterminatedQuote},
+		{`"a`, nil, errUnterminatedQuote},
+		{`"a\"`, nil, errUnterminatedQuote},
+		{`a 'b" c`, nil, errUnterminatedQuote},
+	}
+
+	for _, tt := range tests {
+		words, err := splitShellWords(tt.in)
+		if err != tt.err || !reflect.DeepEqual(words, tt.words) {
+			t.Errorf("splitShellWords(%q) = %q, %v; want %q, %v", tt.in, words, err, tt.words, tt.err)
+		}
+	}
+}
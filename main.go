@@ -15,7 +15,9 @@ import (
 	"regexp"
 	"strconv"
 	"sync/atomic"
+	"syscall"
 	plainTmpl "text/template"
+	"time"
 
 	"flag"
 	"log"
@@ -25,6 +27,12 @@ var (
 	errJobNotFound    = errors.New("job ID not found")
 	errJobExists      = errors.New("job with the ID already exists")
 	errJobNotFinished = errors.New("job not finished")
+	errJobNotRunning  = errors.New("job has no running processes")
+	errJobStarted     = errors.New("job already started")
+
+	errJobRecordMismatch = errors.New("job record does not match its filename")
+	errBadJobIDFormat    = errors.New("bad job ID format in configuration")
+	errBadJobID          = errors.New("job ID may only consist of a-z, 0-9 and dashes")
 
 	errForbidden = errors.New("forbidden")
 )
@@ -42,7 +50,10 @@ var (
 )
 
 var (
-	reJobPath     = regexp.MustCompile(`^/jobs/([a-z0-9-]+)(?:/(kill|remove|log)?)?$`)
+	/* job IDs name directories and files, and must fit the paths below */
+	reJobID = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+	reJobPath     = regexp.MustCompile(`^/jobs/([a-z0-9-]+)(?:/(kill|stop|remove|log)?)?$`)
 	reGatewayPath = regexp.MustCompile(`^/enter/([a-z0-9-]+)/`)
 	reDeployPath  = regexp.MustCompile(`^/deploy/([a-z0-9-]+)`)
 )
@@ -69,11 +80,44 @@ func initPaths() {
 }
 
 type Deployable struct {
-	ID           string `json:"ID"`
-	Desc         string `json:"Desc"`
-	LaunchScript string `json:"LaunchScript"`
-	JobIDFormat  string `json:"JobIDFormat"`
-	Public       bool   `json:"Public"`
+	ID           string            `json:"ID"`
+	Desc         string            `json:"Desc"`
+	LaunchScript string            `json:"LaunchScript"`
+	Args         []string          `json:"Args"`
+	WorkDir      string            `json:"WorkDir"`
+	Env          map[string]string `json:"Env"`
+	PassEnv      []string          `json:"PassEnv"`
+	JobIDFormat  string            `json:"JobIDFormat"`
+	Public       bool              `json:"Public"`
+	Params       []deployParam     `json:"Params"`
+	Profiles     []string          `json:"Profiles"`
+
+	IdleTimeout  duration `json:"IdleTimeout"`
+	UserJobQuota int      `json:"UserJobQuota"`
+
+	Limits cgroupLimits `json:"Limits"`
+
+	Readiness *readinessProbe `json:"Readiness"`
+	Upstream  upstreamConfig  `json:"Upstream"`
+	Egress    egressPolicy    `json:"Egress"`
+	Bandwidth bandwidthLimits `json:"Bandwidth"`
+}
+
+/* duration is a time.Duration given as a string such as "1h30m" in JSON */
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
 }
 
 var (
@@ -83,13 +127,27 @@ var (
 
 func readTemplates() (*template.Template, error) {
 	funcMap := template.FuncMap{
-		"sh":   Sh,
-		"link": Link,
+		"sh":    Sh,
+		"link":  Link,
+		"bytes": formatBytes,
 	}
 
 	return template.New("").Funcs(funcMap).ParseGlob(templatesPath + "/*")
 }
 
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func loadTemplates() {
 	new, err := readTemplates()
 	if err != nil {
@@ -115,7 +173,13 @@ func tmpl() *template.Template {
 }
 
 func execTmpl(w http.ResponseWriter, name string, data interface{}) {
-	err := tmpl().ExecuteTemplate(w, name, data)
+	execTmplStatus(w, http.StatusOK, name, data)
+}
+
+/* execTmplStatus renders the page before sending it with status, so that errors get a clean 500 */
+func execTmplStatus(w http.ResponseWriter, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	err := tmpl().ExecuteTemplate(&buf, name, data)
 	if err != nil {
 		if *flagDebug {
 			http.Error(w, err.Error(), 500)
@@ -123,7 +187,10 @@ func execTmpl(w http.ResponseWriter, name string, data interface{}) {
 			http.Error(w, "internal server error", 500)
 		}
 		log.Printf("executing template %s: %s\n", name, err)
+		return
 	}
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
 }
 
 func readDeployables() (ret []Deployable, err error) {
@@ -132,6 +199,40 @@ func readDeployables() (ret []Deployable, err error) {
 		return
 	}
 	err = json.Unmarshal(contents, &ret)
+	if err != nil {
+		return
+	}
+	for _, d := range ret {
+		err = d.Limits.check(cgroupJobsPath)
+		if err == nil {
+			err = d.Readiness.check()
+		}
+		if err == nil {
+			err = d.Upstream.check()
+		}
+		if err == nil {
+			err = d.Egress.check()
+		}
+		if err == nil {
+			err = d.Bandwidth.check()
+		}
+		if err == nil {
+			_, err = d.argv()
+		}
+		if err == nil {
+			_, err = d.workDir(launchContext{})
+		}
+		if err == nil {
+			err = d.checkProfiles()
+		}
+		for i := 0; err == nil && i < len(d.Params); i++ {
+			err = d.Params[i].check()
+		}
+		if err != nil {
+			err = fmt.Errorf("deployable %s: %s", d.ID, err)
+			return
+		}
+	}
 	return
 }
 
@@ -170,8 +271,9 @@ func lookupEnv(id string) *Deployable {
 
 func listJobs(w http.ResponseWriter, r *http.Request, u user) {
 	type JobInfo struct {
-		ID, Owner string
-		Running   bool
+		ID, Owner, Profile string
+		State, Exit        string
+		Usage              *cgroupUsage
 	}
 
 	jobsInfo := []JobInfo{}
@@ -183,16 +285,26 @@ func listJobs(w http.ResponseWriter, r *http.Request, u user) {
 		jobsInfo = append(jobsInfo, JobInfo{
 			job.ID,
 			string(job.Owner),
-			job.Started && !job.Finished,
+			job.Profile,
+			job.State(),
+			job.ExitDescription(),
+			job.Usage(),
 		})
 	}
 	jobs.RUnlock()
 
+	deployables := getDeployables()
+	profiles := make(map[string][]*resourceProfile)
+	for _, d := range deployables {
+		profiles[d.ID] = d.allowedProfiles(u)
+	}
+
 	flashMessages := getFlashMessages(w, r)
 	execTmpl(w, "list", map[string]interface{}{
 		"flashMessages": flashMessages,
 		"Jobs":          jobsInfo,
-		"Deployables":   getDeployables(),
+		"Deployables":   deployables,
+		"Profiles":      profiles,
 	})
 }
 
@@ -201,6 +313,53 @@ func setFlashAndRedirect(w http.ResponseWriter, r *http.Request, url string, typ
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
+// deployJob creates and starts a new job of the deployable d owned by u,
+// given parameter values already validated by parseParams and the profile
+// chosen with pickProfile. If the job got created but failed to start, it
+// is returned along with the error.
+func deployJob(d *Deployable, u user, params map[string]string, profile *resourceProfile) (*job, error) {
+	var jobID bytes.Buffer
+
+	t0 := time.Now()
+	defer func() {
+		deployDuration.WithLabelValues(d.ID).Observe(time.Since(t0).Seconds())
+	}()
+
+	IDTmpl, err := plainTmpl.New("id").Parse(d.JobIDFormat)
+	if err != nil {
+		log.Printf("error in job ID template for %s: %s\n", d.ID, err)
+		return nil, errBadJobIDFormat
+	}
+	var rid [2]byte
+	rand.Read(rid[:])
+	err = IDTmpl.Execute(&jobID, struct {
+		Owner  string
+		Random string
+		Params map[string]string
+	}{string(u), hex.EncodeToString(rid[:]), params})
+	if err != nil {
+		log.Printf("error in job ID template for %s: %s\n", d.ID, err)
+		return nil, errBadJobIDFormat
+	}
+
+	argv, err := d.argv()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := d.workDir(launchContext{jobID.String(), string(u), d.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := jobs.CreateJob(jobID.String(), u, d, params, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = job.Start(argv, d.environ(job), dir, d.Readiness, d.Egress)
+	return job, err
+}
+
 func deploy(w http.ResponseWriter, r *http.Request, user_ user) {
 	match := reDeployPath.FindStringSubmatch(r.URL.Path)
 	if len(match) < 2 {
@@ -214,36 +373,37 @@ func deploy(w http.ResponseWriter, r *http.Request, user_ user) {
 		return
 	}
 
-	var jobID bytes.Buffer
-
-	IDTmpl, err := plainTmpl.New("id").Parse(d.JobIDFormat)
-	if err == nil || d.JobIDFormat == "" {
-		var rid [2]byte
-		rand.Read(rid[:])
-		IDTmpl.Execute(&jobID, struct {
-			Owner  string
-			Random string
-		}{string(user_), hex.EncodeToString(rid[:])})
-	}
+	r.ParseForm()
+	params, err := d.parseParams(func(name string) (string, bool) {
+		vs := r.Form[paramFormPrefix+name]
+		if len(vs) == 0 {
+			return "", false
+		}
+		/* the last one wins so that checkboxes can override a hidden input */
+		return vs[len(vs)-1], true
+	})
 	if err != nil {
-		log.Printf("error in job ID template for %s: %s\n", d.ID, err)
-		http.Error(w, "internal server error", 500)
+		setFlashAndRedirect(w, r, Link("/"), "error", err.Error())
+		return
 	}
 
-	job, err := jobs.CreateJob(jobID.String(), user_)
+	profile, err := d.pickProfile(user_, r.FormValue("profile"))
 	if err != nil {
-		setFlashMessages(w, []flashMessage{{ID: "error", Args: []string{err.Error()}}})
-		http.Redirect(w, r, Link("/"), http.StatusFound)
+		setFlashAndRedirect(w, r, Link("/"), "error", err.Error())
 		return
 	}
-	job.Public = d.Public
 
-	envs := append(os.Environ(),
-		fmt.Sprintf("WEB_BASE_PATH=%s/enter/%s", *flagBasePath, jobID.String()),
-		fmt.Sprintf("JOB_OWNER=%s", user_),
-	)
-	job.Start(d.LaunchScript, envs, "/")
-	setFlashAndRedirect(w, r, Link("/jobs/"+jobID.String()), "success", "Deployment successful")
+	job, err := deployJob(d, user_, params, profile)
+	if err != nil && job != nil {
+		setFlashAndRedirect(w, r, Link("/jobs/"+job.ID), "error",
+			fmt.Sprintf("Deployment failed: %s", err))
+		return
+	}
+	if err != nil {
+		setFlashAndRedirect(w, r, Link("/"), "error", err.Error())
+		return
+	}
+	setFlashAndRedirect(w, r, Link("/jobs/"+job.ID), "success", "Deployment successful")
 }
 
 func handleJob(w http.ResponseWriter, r *http.Request, u user) {
@@ -257,6 +417,10 @@ func handleJob(w http.ResponseWriter, r *http.Request, u user) {
 		http.Error(w, "job not found", 404)
 		return
 	}
+	if !u.CanManageJob(job) {
+		http.Error(w, "forbidden. you are not the job owner, neither are you an administrator", 403)
+		return
+	}
 
 	if len(match) >= 3 && match[2] != "" {
 		if match[2] == "log" && r.Method == "GET" {
@@ -276,10 +440,20 @@ func handleJob(w http.ResponseWriter, r *http.Request, u user) {
 				http.Error(w, "no signal number", http.StatusBadRequest)
 				return
 			}
-			job.SendSignal(no)
+			err = job.SendSignal(syscall.Signal(no))
+			if err != nil {
+				setFlashAndRedirect(w, r, Link("/jobs/"+job.ID), "error",
+					fmt.Sprintf("Job %s could not be sent signal %d: %s", job.ID, no, err))
+				return
+			}
 			setFlashAndRedirect(w, r, Link("/jobs/"+job.ID), "success",
 				fmt.Sprintf("Job %s was sent signal %d", job.ID, no))
 			return
+		case "stop":
+			go job.Stop()
+			setFlashAndRedirect(w, r, Link("/jobs/"+job.ID), "success",
+				fmt.Sprintf("Job %s is being stopped", job.ID))
+			return
 		case "remove":
 			err := jobs.Remove(job.ID)
 			if err != nil {
@@ -293,11 +467,6 @@ func handleJob(w http.ResponseWriter, r *http.Request, u user) {
 			return
 		}
 	} else {
-		if !u.CanManageJob(job) {
-			http.Error(w, "forbidden. you are not the job owner, neither are you an administrator", 403)
-			return
-		}
-
 		flashMessages := getFlashMessages(w, r)
 		execTmpl(w, "job_detail", map[string]interface{}{
 			"flashMessages": flashMessages,
@@ -322,7 +491,38 @@ func handleGateway(w http.ResponseWriter, r *http.Request, u user) {
 		return
 	}
 
-	job.ReverseProxy.ServeHTTP(w, r)
+	if job.State() == "starting" || job.IsFinished() {
+		serveGatewayError(w, r, job, nil)
+		return
+	}
+
+	job.touch()
+	defer job.touch()
+	instrumentGateway(job, job.ReverseProxy).ServeHTTP(w, r)
+}
+
+// serveGatewayError explains to the user why the job's gateway could not
+// serve the request r. It is also used as the ErrorHandler of the job's
+// ReverseProxy.
+func serveGatewayError(w http.ResponseWriter, r *http.Request, job *job, err error) {
+	if err != nil {
+		log.Printf("gateway of job %s: %s", job.ID, err)
+	}
+
+	data := map[string]interface{}{
+		"Job":       job,
+		"CanManage": getRequestUser(r).CanManageJob(job),
+	}
+
+	switch {
+	case job.IsFinished():
+		execTmplStatus(w, http.StatusGone, "gateway_ended", data)
+	case job.State() == "starting":
+		w.Header().Set("Retry-After", "2")
+		execTmplStatus(w, http.StatusServiceUnavailable, "gateway_starting", data)
+	default:
+		execTmplStatus(w, http.StatusBadGateway, "gateway_error", data)
+	}
 }
 
 func getRequestUser(r *http.Request) user {
@@ -354,10 +554,16 @@ func main() {
 
 	initPaths()
 	initTemplates()
-	initDeployables()
 	initCgroup()
+	initProfiles()
+	initDeployables()
 	initUsers()
 	initNet()
+	initStore()
+	initMetrics()
+	loadJobs()
+	recoverJobs()
+	go cullIdleJobs()
 
 	mux := http.NewServeMux()
 
@@ -366,6 +572,12 @@ func main() {
 	mux.HandleFunc("/jobs/", requireLogin(handleJob))
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(staticPath))))
 	mux.HandleFunc("/enter/", requireLogin(handleGateway))
+	mux.HandleFunc("/api/v1/", requireLogin(handleAPI))
+	if *flagMetricsListenAddr != "" {
+		go serveMetrics()
+	} else {
+		mux.HandleFunc("/metrics", requireLogin(handleMetrics))
+	}
 
 	h := http.StripPrefix(*flagBasePath, mux)
 	err := http.ListenAndServe(*flagListenAddr, h)
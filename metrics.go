@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	flagMetricsListenAddr = flag.String("metrics_listen", "", "address to serve metrics on without authentication, instead of to admins on the main listener")
+)
+
+var (
+	deployDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "envdeploy_deploy_duration_seconds",
+		Help: "Time taken to create and start a job.",
+	}, []string{"deployable"})
+
+	jobsStarted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "envdeploy_jobs_started_total",
+		Help: "Number of jobs started.",
+	}, []string{"deployable"})
+
+	jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "envdeploy_jobs_finished_total",
+		Help: "Number of jobs which finished.",
+	}, []string{"deployable"})
+
+	gatewayRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "envdeploy_gateway_requests_total",
+		Help: "Number of requests passed through the gateway of a job, by status code.",
+	}, []string{"job", "code"})
+
+	gatewayDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "envdeploy_gateway_request_duration_seconds",
+		Help: "Duration of requests passed through the gateway of a job.",
+	}, []string{"job"})
+)
+
+var (
+	descJobs = prometheus.NewDesc("envdeploy_jobs",
+		"Number of jobs by state and deployable.", []string{"state", "deployable"}, nil)
+	descJobCPU = prometheus.NewDesc("envdeploy_job_cpu_seconds_total",
+		"CPU time consumed by the cgroup of a job.", []string{"job", "owner"}, nil)
+	descJobMemory = prometheus.NewDesc("envdeploy_job_memory_bytes",
+		"Current memory usage of the cgroup of a job.", []string{"job", "owner"}, nil)
+)
+
+/* jobsCollector reports on the jobs map as it is at the time of scraping */
+type jobsCollector struct{}
+
+func (jobsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descJobs
+	ch <- descJobCPU
+	ch <- descJobMemory
+}
+
+func (jobsCollector) Collect(ch chan<- prometheus.Metric) {
+	type key struct{ state, deployable string }
+	counts := make(map[key]int)
+
+	jobs.RLock()
+	defer jobs.RUnlock()
+
+	for _, j := range jobs.m {
+		counts[key{j.State(), j.Deployable}]++
+
+		u := j.Usage()
+		if u == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(descJobCPU, prometheus.CounterValue,
+			u.CPUTime().Seconds(), j.ID, string(j.Owner))
+		ch <- prometheus.MustNewConstMetric(descJobMemory, prometheus.GaugeValue,
+			float64(u.MemoryCurrent), j.ID, string(j.Owner))
+	}
+
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(descJobs, prometheus.GaugeValue,
+			float64(n), k.state, k.deployable)
+	}
+}
+
+func initMetrics() {
+	prometheus.MustRegister(
+		deployDuration,
+		jobsStarted,
+		jobsFinished,
+		gatewayRequests,
+		gatewayDuration,
+		jobsCollector{},
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+/* handleMetrics serves the metrics on the main listener, to admins only */
+func handleMetrics(w http.ResponseWriter, r *http.Request, u user) {
+	if !u.IsAdmin() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	metricsHandler().ServeHTTP(w, r)
+}
+
+/* serveMetrics serves the metrics unauthenticated on their own listener */
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	log.Fatal(http.ListenAndServe(*flagMetricsListenAddr, mux))
+}
+
+/* instrumentGateway wraps the gateway of job j in request counting and timing */
+func instrumentGateway(j *job, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"job": j.ID}
+	return promhttp.InstrumentHandlerDuration(gatewayDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(gatewayRequests.MustCurryWith(labels), h))
+}
+
+/* forgetJobMetrics drops the per-job series of a removed job */
+func forgetJobMetrics(id string) {
+	labels := prometheus.Labels{"job": id}
+	gatewayRequests.DeletePartialMatch(labels)
+	gatewayDuration.DeletePartialMatch(labels)
+}
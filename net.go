@@ -1,11 +1,15 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
 func initNet() {
+	initAddrPools()
+	initFirewall()
 }
 
 func createRouteFromCurrentNetns(hostIfName string) error {
@@ -39,3 +43,26 @@ func runInBackgroundNetns(payload func() error) error {
 	}()
 	return <-finishedch
 }
+
+/* listHostIfs returns the names of host-side veth interfaces of jobs */
+func listHostIfs() (ret []string, err error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return
+	}
+	for _, l := range links {
+		name := l.Attrs().Name
+		if strings.HasPrefix(name, hostIfPrefix) {
+			ret = append(ret, name)
+		}
+	}
+	return
+}
+
+func deleteHostIf(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(l)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var reParamName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+/* deploy form fields of parameters are prefixed so as not to clash with the form's other fields */
+const paramFormPrefix = "param."
+
+/* deployParam is an input the user supplies when deploying */
+type deployParam struct {
+	Name    string `json:"Name"`
+	Label   string `json:"Label"`
+	Type    string `json:"Type"` /* "string", "int", "enum" or "bool" */
+	Default string `json:"Default"`
+
+	/* for "int" */
+	Min *int `json:"Min"`
+	Max *int `json:"Max"`
+	/* for "enum" */
+	Choices []string `json:"Choices"`
+	/* for "string", a regular expression the whole value has to match,
+	   any value is accepted if empty */
+	Pattern string `json:"Pattern"`
+
+	/* Pattern compiled by check */
+	re *regexp.Regexp
+}
+
+/* paramError is a parameter value failing validation */
+type paramError struct {
+	Param string
+	Msg   string
+}
+
+func (e *paramError) Error() string {
+	return fmt.Sprintf("parameter %s: %s", e.Param, e.Msg)
+}
+
+/* EnvName is the variable the launch script finds the value in */
+func (p *deployParam) EnvName() string {
+	return "PARAM_" + strings.ToUpper(p.Name)
+}
+
+/* FormName is the deploy form field the value is submitted in */
+func (p *deployParam) FormName() string {
+	return paramFormPrefix + p.Name
+}
+
+func (p *deployParam) check() error {
+	if !reParamName.MatchString(p.Name) {
+		return fmt.Errorf("bad parameter name %q", p.Name)
+	}
+	switch p.Type {
+	case "string":
+		if p.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+			if err != nil {
+				return err
+			}
+			p.re = re
+		}
+	case "int", "enum", "bool":
+	default:
+		return fmt.Errorf("parameter %s: unknown type %q", p.Name, p.Type)
+	}
+	_, err := p.validate(p.Default)
+	return err
+}
+
+/* validate checks v against the parameter's type, returning its canonical form */
+func (p *deployParam) validate(v string) (string, error) {
+	switch p.Type {
+	case "int":
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return "", &paramError{p.Name, "not an integer"}
+		}
+		if p.Min != nil && n < *p.Min {
+			return "", &paramError{p.Name, fmt.Sprintf("must be at least %d", *p.Min)}
+		}
+		if p.Max != nil && n > *p.Max {
+			return "", &paramError{p.Name, fmt.Sprintf("must be at most %d", *p.Max)}
+		}
+		return strconv.Itoa(n), nil
+	case "enum":
+		for _, c := range p.Choices {
+			if v == c {
+				return v, nil
+			}
+		}
+		return "", &paramError{p.Name, fmt.Sprintf("must be one of %s", strings.Join(p.Choices, ", "))}
+	case "bool":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return "", &paramError{p.Name, "not a boolean"}
+		}
+		return strconv.FormatBool(b), nil
+	default:
+		if p.re != nil && !p.re.MatchString(v) {
+			return "", &paramError{p.Name, "does not match the required format"}
+		}
+		return v, nil
+	}
+}
+
+// parseParams validates the parameter values obtained through get, filling
+// in defaults for those not supplied.
+func (d *Deployable) parseParams(get func(name string) (string, bool)) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, p := range d.Params {
+		v, ok := get(p.Name)
+		if !ok {
+			v = p.Default
+		}
+		v, err := p.validate(v)
+		if err != nil {
+			return nil, err
+		}
+		ret[p.Name] = v
+	}
+	return ret, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDeployParamValidate(t *testing.T) {
+	one, ten := 1, 10
+	var (
+		anyString = deployParam{Type: "string"}
+		letters   = deployParam{Type: "string", Pattern: "[a-z]+", Default: "x"}
+		aOrB      = deployParam{Type: "string", Pattern: "a|b", Default: "a"}
+		anyInt    = deployParam{Type: "int", Default: "0"}
+		oneToTen  = deployParam{Type: "int", Min: &one, Max: &ten, Default: "1"}
+		size      = deployParam{Type: "enum", Choices: []string{"small", "large"}, Default: "small"}
+		toggle    = deployParam{Type: "bool", Default: "false"}
+	)
+	tests := []struct {
+		param deployParam
+		in    string
+		out   string
+		ok    bool
+	}{
+		/* without a pattern, any string goes */
+		{anyString, "", "", true},
+		{anyString, "anything at all\n", "anything at all\n", true},
+		{letters, "abc", "abc", true},
+		{letters, "", "", false},
+		/* the whole value has to match, not just part of it */
+		{letters, "abc1", "", false},
+		{letters, "1abc", "", false},
+		{aOrB, "ab", "", false},
+		{aOrB, "b", "b", true},
+		{anyInt, "42", "42", true},
+		{anyInt, " 007 ", "7", true},
+		{anyInt, "-3", "-3", true},
+		{anyInt, "4.2", "", false},
+		{anyInt, "", "", false},
+		{oneToTen, "1", "1", true},
+		{oneToTen, "10", "10", true},
+		{oneToTen, "0", "", false},
+		{oneToTen, "11", "", false},
+		{size, "large", "large", true},
+		{size, "Large", "", false},
+		{size, "", "", false},
+		{toggle, "true", "true", true},
+		{toggle, "1", "true", true},
+		{toggle, "F", "false", true},
+		{toggle, "yes", "", false},
+	}
+
+	for _, tt := range tests {
+		p := tt.param
+		p.Name = "test"
+		if err := p.check(); err != nil {
+			t.Fatalf("%+v.check(): %s", tt.param, err)
+		}
+		out, err := p.validate(tt.in)
+		if (err == nil) != tt.ok || out != tt.out {
+			t.Errorf("%+v.validate(%q) = %q, %v; want %q, ok %v", tt.param, tt.in, out, err, tt.out, tt.ok)
+		}
+		if _, isParamErr := err.(*paramError); err != nil && !isParamErr {
+			t.Errorf("%+v.validate(%q) returned %T, want *paramError", tt.param, tt.in, err)
+		}
+	}
+}
+
+func TestDeployParamCheck(t *testing.T) {
+	tests := []struct {
+		param deployParam
+		ok    bool
+	}{
+		{deployParam{Name: "name", Type: "string"}, true},
+		{deployParam{Name: "name", Type: "string", Pattern: ""}, true},
+		{deployParam{Name: "name", Type: "string", Pattern: "[a-z]+", Default: "x"}, true},
+		/* the default has to be valid too */
+		{deployParam{Name: "name", Type: "string", Pattern: "[a-z]+"}, false},
+		{deployParam{Name: "name", Type: "string", Pattern: "[a-z"}, false},
+		{deployParam{Name: "count", Type: "int", Default: "3"}, true},
+		{deployParam{Name: "count", Type: "int"}, false},
+		{deployParam{Name: "size", Type: "enum", Choices: []string{"s"}, Default: "m"}, false},
+		{deployParam{Name: "name", Type: "float", Default: "1"}, false},
+		{deployParam{Name: "_name", Type: "string"}, true},
+		{deployParam{Name: "1name", Type: "string"}, false},
+		{deployParam{Name: "my-name", Type: "string"}, false},
+		{deployParam{Name: "my_name2", Type: "string"}, true},
+	}
+
+	for _, tt := range tests {
+		p := tt.param
+		err := p.check()
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v.check() = %v, want ok %v", tt.param, err, tt.ok)
+		}
+	}
+}
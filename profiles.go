@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync/atomic"
+)
+
+var (
+	flagProfilesFile = flag.String("profiles", "", "path to configuration file listing resource profiles")
+)
+
+var (
+	errProfileNotFound   = errors.New("resource profile not found")
+	errProfileNotAllowed = errors.New("resource profile not allowed")
+)
+
+// resourceProfile is a named bundle of cgroup limits users may choose from
+// when deploying. It is available to the users listed and to members of
+// the system groups listed, or to everyone if neither is given.
+type resourceProfile struct {
+	ID     string       `json:"ID"`
+	Desc   string       `json:"Desc"`
+	Limits cgroupLimits `json:"Limits"`
+
+	Users  []user   `json:"Users"`
+	Groups []string `json:"Groups"`
+}
+
+var profiles atomic.Value /* []resourceProfile */
+
+func (p *resourceProfile) AllowedTo(u user) bool {
+	if len(p.Users) == 0 && len(p.Groups) == 0 {
+		return true
+	}
+	if u.IsAdmin() {
+		return true
+	}
+	for _, pu := range p.Users {
+		if pu == u {
+			return true
+		}
+	}
+	for _, g := range p.Groups {
+		if u.InGroup(g) {
+			return true
+		}
+	}
+	return false
+}
+
+func readProfiles() (ret []resourceProfile, err error) {
+	if *flagProfilesFile == "" {
+		return []resourceProfile{}, nil
+	}
+	contents, err := ioutil.ReadFile(*flagProfilesFile)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(contents, &ret)
+	if err != nil {
+		return
+	}
+	for _, p := range ret {
+		err = p.Limits.check(cgroupJobsPath)
+		if err != nil {
+			err = fmt.Errorf("profile %s: %s", p.ID, err)
+			return
+		}
+	}
+	return
+}
+
+func loadProfiles() {
+	new, err := readProfiles()
+	if err != nil {
+		log.Printf("error reading %s: %s", *flagProfilesFile, err)
+		return
+	}
+	profiles.Store(new)
+}
+
+func getProfiles() []resourceProfile {
+	if *flagDebug {
+		loadProfiles()
+	}
+	return profiles.Load().([]resourceProfile)
+}
+
+func initProfiles() {
+	loadProfiles()
+	if profiles.Load() == nil {
+		log.Fatal("failed to read resource profiles")
+	}
+}
+
+func lookupProfile(id string) *resourceProfile {
+	for _, p := range getProfiles() {
+		if p.ID == id {
+			return &p
+		}
+	}
+	return nil
+}
+
+func (d *Deployable) checkProfiles() error {
+	for _, id := range d.Profiles {
+		if lookupProfile(id) == nil {
+			return fmt.Errorf("%s: %s", errProfileNotFound, id)
+		}
+	}
+	return nil
+}
+
+/* allowedProfiles lists the profiles of d which u may pick, the default first */
+func (d *Deployable) allowedProfiles(u user) (ret []*resourceProfile) {
+	for _, id := range d.Profiles {
+		p := lookupProfile(id)
+		if p != nil && p.AllowedTo(u) {
+			ret = append(ret, p)
+		}
+	}
+	return
+}
+
+// pickProfile resolves the profile u asked for when deploying d, with ""
+// standing for the first profile allowed. Deployables which list no
+// profiles get nil.
+func (d *Deployable) pickProfile(u user, id string) (*resourceProfile, error) {
+	if len(d.Profiles) == 0 {
+		if id != "" {
+			return nil, errProfileNotAllowed
+		}
+		return nil, nil
+	}
+
+	allowed := d.allowedProfiles(u)
+	if len(allowed) == 0 {
+		return nil, errProfileNotAllowed
+	}
+	if id == "" {
+		return allowed[0], nil
+	}
+	for _, p := range allowed {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	if lookupProfile(id) == nil {
+		return nil, errProfileNotFound
+	}
+	return nil, errProfileNotAllowed
+}
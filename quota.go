@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var (
+	flagUserJobQuota  = flag.Int("user_job_quota", 0, "maximum number of unfinished jobs per user, 0 for unlimited")
+	flagAdminJobQuota = flag.Int("admin_job_quota", 0, "maximum number of unfinished jobs per admin, 0 for unlimited; per-deployable quotas do not apply to admins")
+)
+
+/* quotaError is a deploy refused because the owner has too many jobs */
+type quotaError struct {
+	Deployable string /* empty for the global quota */
+	Limit      int
+}
+
+func (e *quotaError) Error() string {
+	if e.Deployable != "" {
+		return fmt.Sprintf("job quota exceeded: at most %d unfinished jobs of %s allowed per user", e.Limit, e.Deployable)
+	}
+	return fmt.Sprintf("job quota exceeded: at most %d unfinished jobs allowed per user", e.Limit)
+}
+
+// checkQuota tells whether owner may have one more job of d. The caller
+// must hold the jobs lock so that concurrent deploys are counted.
+func (jobs *jobsMap) checkQuota(owner user, d *Deployable) error {
+	total, ofDeployable := 0, 0
+	for _, j := range jobs.m {
+		if j.Owner != owner || j.IsFinished() {
+			continue
+		}
+		total++
+		if j.Deployable == d.ID {
+			ofDeployable++
+		}
+	}
+
+	if owner.IsAdmin() {
+		if *flagAdminJobQuota > 0 && total >= *flagAdminJobQuota {
+			return &quotaError{Limit: *flagAdminJobQuota}
+		}
+		return nil
+	}
+
+	if *flagUserJobQuota > 0 && total >= *flagUserJobQuota {
+		return &quotaError{Limit: *flagUserJobQuota}
+	}
+	if d.UserJobQuota > 0 && ofDeployable >= d.UserJobQuota {
+		return &quotaError{Deployable: d.ID, Limit: d.UserJobQuota}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultReadinessTimeout  = 2 * time.Minute
+	defaultReadinessInterval = 1 * time.Second
+)
+
+/* readinessProbe configures how to tell a job is ready to serve requests */
+type readinessProbe struct {
+	/* either "tcp" to merely connect, or "http" */
+	Type string `json:"Type"`
+	/* path requested by HTTP probes, relative to the job's WEB_BASE_PATH */
+	Path string `json:"Path"`
+
+	Timeout  duration `json:"Timeout"`
+	Interval duration `json:"Interval"`
+}
+
+func (p *readinessProbe) check() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Type {
+	case "tcp", "http":
+		return nil
+	default:
+		return fmt.Errorf("unknown readiness probe type %q", p.Type)
+	}
+}
+
+/* probe makes a single attempt at reaching the job's upstream, giving up after timeout */
+func (p *readinessProbe) probe(j *job, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if p.Type == "tcp" {
+		conn, err := j.Upstream.dial(ctx, j.Dialer)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "/enter/"+j.ID+p.Path, nil)
+	if err != nil {
+		return err
+	}
+	j.ReverseProxy.Director(req)
+	resp, err := j.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("readiness probe got status %s", resp.Status)
+	}
+	return nil
+}
+
+// awaitReady probes the job until it becomes ready, marking it so. A job
+// which does not become ready within the probe's timeout is marked failed
+// and stopped.
+func (j *job) awaitReady(p *readinessProbe) {
+	timeout, interval := time.Duration(p.Timeout), time.Duration(p.Interval)
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+	if interval <= 0 {
+		interval = defaultReadinessInterval
+	}
+
+	end := time.Now().Add(timeout)
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var err error
+	for {
+		if j.IsFinished() {
+			return
+		}
+
+		attempt := time.Until(end)
+		if attempt > interval {
+			attempt = interval
+		}
+		err = p.probe(j, attempt)
+		if err == nil {
+			j.Statem.Lock()
+			j.Ready = true
+			j.Statem.Unlock()
+			j.save()
+			return
+		}
+
+		select {
+		case <-deadline:
+			log.Printf("job %s not ready within %s: %s", j.ID, timeout, err)
+			fmt.Fprintf(j.Stderr, "envdeploy: not ready within %s: %s\n", timeout, err)
+
+			j.Statem.Lock()
+			j.FailReason = fmt.Sprintf("not ready within %s", timeout)
+			j.Statem.Unlock()
+			j.Stop()
+			return
+		case <-ticker.C:
+		}
+	}
+}
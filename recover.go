@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// recoverJobs reconciles the restored jobs with what survived of them on the
+// system: it re-attaches gateways to jobs still running and tears down
+// cgroups, veth interfaces and socket directories left behind by jobs
+// nobody remembers.
+func recoverJobs() {
+	liveCgroups := make(map[string]bool)
+	liveIfs := make(map[string]bool)
+	liveSocketDirs := make(map[string]bool)
+
+	jobs.RLock()
+	for _, j := range jobs.m {
+		if j.IsFinished() {
+			j.Dialer.Quit()
+			continue
+		}
+
+		liveCgroups[j.Cgroup] = true
+		liveIfs[j.HostIf] = true
+		if j.Upstream.Socket != "" {
+			liveSocketDirs[j.ID] = true
+		}
+
+		/* the lease is given back once the adopted dialer quits, or
+		   right away if the job cannot be adopted; a job with addresses
+		   from another pool is not, as its lease names a different pair */
+		leased := false
+		veth, err := reserveVeth(j.HostIf)
+		if err == nil && veth != j.veth() {
+			releaseVeth(j.HostIf)
+		} else if err == nil {
+			leased = true
+		}
+		forgetVeth := func() {
+			if leased {
+				releaseVeth(j.HostIf)
+			}
+			delete(liveIfs, j.HostIf)
+		}
+
+		pids := cgroupMemberPids(j.Cgroup)
+		if len(pids) == 0 {
+			/* e.g. after a reboot, there is nothing to wait for */
+			log.Printf("job %s has no processes left", j.ID)
+			j.finish()
+			forgetVeth()
+			continue
+		}
+		if !leased {
+			log.Printf("job %s has addresses outside of the current pool, leaving it without a gateway", j.ID)
+			j.Dialer.Quit()
+			forgetVeth()
+		} else if err := AdoptNetnsWithDialer(pids[0], j.Dialer, j.veth()); err != nil {
+			log.Printf("re-attaching gateway of job %s: %s", j.ID, err)
+			j.Dialer.Quit()
+			forgetVeth()
+		} else {
+			log.Printf("re-attached gateway of job %s via pid %d", j.ID, pids[0])
+		}
+
+		go j.watchFinish()
+		if d := lookupEnv(j.Deployable); !j.Ready && d != nil && d.Readiness != nil {
+			go j.awaitReady(d.Readiness)
+		} else {
+			j.Statem.Lock()
+			j.Ready = true
+			j.Statem.Unlock()
+		}
+	}
+	jobs.RUnlock()
+
+	/* job cgroups are found in per-user cgroups, or directly under
+	   cgroupJobsPath if left by a server predating per-user cgroups */
+	var jobCgroups, userCgroups []string
+	entries, err := ioutil.ReadDir(cgroupJobsPath)
+	if err != nil {
+		log.Printf("scanning %s: %s", cgroupJobsPath, err)
+	}
+	for _, e := range entries {
+		dir := path.Join(cgroupJobsPath, e.Name())
+		if !e.IsDir() {
+			continue
+		}
+		if !strings.HasPrefix(e.Name(), userCgroupPrefix) {
+			jobCgroups = append(jobCgroups, dir)
+			continue
+		}
+
+		userCgroups = append(userCgroups, dir)
+		subentries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Printf("scanning %s: %s", dir, err)
+		}
+		for _, se := range subentries {
+			if se.IsDir() {
+				jobCgroups = append(jobCgroups, path.Join(dir, se.Name()))
+			}
+		}
+	}
+
+	for _, dir := range jobCgroups {
+		if liveCgroups[dir] {
+			continue
+		}
+
+		log.Printf("removing leftover cgroup %s", dir)
+		killCgroup(dir)
+		go func(dir string) {
+			<-waitForCgroupUnpopulated(dir)
+			err := removeJobCgroup(dir)
+			if err != nil {
+				log.Printf("removing leftover cgroup %s: %s", dir, err)
+			}
+		}(dir)
+	}
+	for _, dir := range userCgroups {
+		releaseUserCgroup(dir)
+	}
+
+	ifs, err := listHostIfs()
+	if err != nil {
+		log.Printf("listing network interfaces: %s", err)
+	}
+	for _, name := range ifs {
+		if liveIfs[name] {
+			continue
+		}
+
+		log.Printf("removing leftover interface %s", name)
+		err := deleteHostIf(name)
+		if err != nil {
+			log.Printf("removing leftover interface %s: %s", name, err)
+		}
+	}
+
+	ifs, err = firewalledHostIfs()
+	if err != nil {
+		log.Printf("listing firewall rules: %s", err)
+	}
+	for _, name := range ifs {
+		if liveIfs[name] {
+			continue
+		}
+
+		log.Printf("removing leftover firewall rules of %s", name)
+		err := removeJobFirewall(name)
+		if err != nil {
+			log.Printf("removing leftover firewall rules of %s: %s", name, err)
+		}
+	}
+
+	entries, err = ioutil.ReadDir(*flagRunDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("scanning %s: %s", *flagRunDir, err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || liveSocketDirs[e.Name()] || !reJobID.MatchString(e.Name()) {
+			continue
+		}
+
+		log.Printf("removing leftover socket directory of job %s", e.Name())
+		err := removeSocketDir(e.Name())
+		if err != nil {
+			log.Printf("removing leftover socket directory of job %s: %s", e.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	errBadRate = errors.New("rate must be a positive number with a unit such as kbit, mbit or gbit")
+)
+
+/* rate units as understood by tc, in bytes per second */
+var rateUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"tbit", 1e12 / 8}, {"gbit", 1e9 / 8}, {"mbit", 1e6 / 8}, {"kbit", 1e3 / 8},
+	{"tbps", 1e12}, {"gbps", 1e9}, {"mbps", 1e6}, {"kbps", 1e3},
+	{"bit", 1.0 / 8}, {"bps", 1},
+}
+
+/* parseRate parses a rate such as "100mbit" into bytes per second */
+func parseRate(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, u := range rateUnits {
+		if !strings.HasSuffix(s, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+		if err != nil || n <= 0 || n*u.bytes < 1 {
+			return 0, errBadRate
+		}
+		return uint64(n * u.bytes), nil
+	}
+	return 0, errBadRate
+}
+
+/* bandwidthLimits caps the traffic rates of a job, e.g. at "100mbit"; empty means unlimited */
+type bandwidthLimits struct {
+	/* traffic towards the job */
+	Ingress string `json:"Ingress"`
+	/* traffic from the job */
+	Egress string `json:"Egress"`
+}
+
+func (b bandwidthLimits) check() error {
+	if b.Ingress != "" {
+		_, err := parseRate(b.Ingress)
+		if err != nil {
+			return fmt.Errorf("bad ingress rate %q: %s", b.Ingress, err)
+		}
+	}
+	if b.Egress != "" {
+		rate, err := parseRate(b.Egress)
+		if err == nil && rate > math.MaxUint32 {
+			err = errors.New("rate too high")
+		}
+		if err != nil {
+			return fmt.Errorf("bad egress rate %q: %s", b.Egress, err)
+		}
+	}
+	return nil
+}
+
+/* shapingBurst is the burst allowed at rate, 10ms worth but at least 16 KiB */
+func shapingBurst(rate uint64) uint32 {
+	burst := rate / 100
+	if burst < 16*1024 {
+		burst = 16 * 1024
+	}
+	if burst > math.MaxUint32 {
+		burst = math.MaxUint32
+	}
+	return uint32(burst)
+}
+
+// shapeHostIf applies the limits to the host end of a job's veth pair.
+// Traffic towards the job leaves through the host end, where a token bucket
+// filter delays it; traffic from the job arrives there and is policed, so
+// that packets over the rate are dropped. The qdiscs go away with the
+// interface.
+func shapeHostIf(hostIf string, limits bandwidthLimits) error {
+	if limits.Ingress == "" && limits.Egress == "" {
+		return nil
+	}
+	link, err := netlink.LinkByName(hostIf)
+	if err != nil {
+		return err
+	}
+
+	if limits.Ingress != "" {
+		rate, err := parseRate(limits.Ingress)
+		if err != nil {
+			return err
+		}
+		burst := shapingBurst(rate)
+		/* at most 50ms worth of queueing beyond the burst */
+		limit := rate/20 + uint64(burst)
+		if limit > math.MaxUint32 {
+			limit = math.MaxUint32
+		}
+		err = netlink.QdiscAdd(&netlink.Tbf{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: link.Attrs().Index,
+				Handle:    netlink.MakeHandle(1, 0),
+				Parent:    netlink.HANDLE_ROOT,
+			},
+			Rate:   rate,
+			Limit:  uint32(limit),
+			Buffer: netlink.Xmittime(rate, burst),
+		})
+		if err != nil {
+			return fmt.Errorf("adding ingress qdisc: %s", err)
+		}
+	}
+
+	if limits.Egress != "" {
+		rate, err := parseRate(limits.Egress)
+		if err != nil {
+			return err
+		}
+		err = netlink.QdiscAdd(&netlink.Ingress{
+			QdiscAttrs: netlink.QdiscAttrs{
+				LinkIndex: link.Attrs().Index,
+				Handle:    netlink.MakeHandle(0xffff, 0),
+				Parent:    netlink.HANDLE_INGRESS,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("adding egress qdisc: %s", err)
+		}
+
+		police := netlink.NewPoliceAction()
+		police.Rate = uint32(rate)
+		police.Burst = shapingBurst(rate)
+		police.ExceedAction = netlink.TC_POLICE_SHOT
+		/* a u32 filter matching every packet, as in tc's "match u32 0 0" */
+		err = netlink.FilterAdd(&netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: link.Attrs().Index,
+				Parent:    netlink.MakeHandle(0xffff, 0),
+				Priority:  1,
+				Protocol:  unix.ETH_P_ALL,
+			},
+			Sel: &netlink.TcU32Sel{
+				Flags: netlink.TC_U32_TERMINAL,
+				Nkeys: 1,
+				Keys:  []netlink.TcU32Key{{}},
+			},
+			Actions: []netlink.Action{police},
+		})
+		if err != nil {
+			return fmt.Errorf("adding egress filter: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		rate uint64
+		err  error
+	}{
+		{"8bit", 1, nil},
+		{"1bps", 1, nil},
+		{"100kbit", 12500, nil},
+		{"100mbit", 12500000, nil},
+		{"1gbit", 125000000, nil},
+		{"1tbit", 125000000000, nil},
+		{"10kbps", 10000, nil},
+		{"10mbps", 10000000, nil},
+		{"2gbps", 2000000000, nil},
+		{"1tbps", 1000000000000, nil},
+		{"1.5mbit", 187500, nil},
+		{" 100MBit ", 12500000, nil},
+		{"40gbps", 40000000000, nil},
+		{"", 0, errBadRate},
+		{"100", 0, errBadRate},
+		{"mbit", 0, errBadRate},
+		{"0mbit", 0, errBadRate},
+		{"-1mbit", 0, errBadRate},
+		{"4bit", 0, errBadRate},
+		{"100 furlongs", 0, errBadRate},
+		{"onembit", 0, errBadRate},
+	}
+
+	for _, tt := range tests {
+		rate, err := parseRate(tt.in)
+		if rate != tt.rate || err != tt.err {
+			t.Errorf("parseRate(%q) = %d, %v; want %d, %v", tt.in, rate, err, tt.rate, tt.err)
+		}
+	}
+}
+
+func TestShapingBurst(t *testing.T) {
+	tests := []struct {
+		rate  uint64
+		burst uint32
+	}{
+		{1, 16 * 1024},
+		{1638400, 16 * 1024},
+		{12500000, 125000},
+		{125000000000, 1250000000},
+		{100 * math.MaxUint32, math.MaxUint32},
+		{math.MaxUint64, math.MaxUint32},
+	}
+
+	for _, tt := range tests {
+		if burst := shapingBurst(tt.rate); burst != tt.burst {
+			t.Errorf("shapingBurst(%d) = %d, want %d", tt.rate, burst, tt.burst)
+		}
+	}
+}
+
+func TestBandwidthLimitsCheck(t *testing.T) {
+	tests := []struct {
+		limits bandwidthLimits
+		ok     bool
+	}{
+		{bandwidthLimits{}, true},
+		{bandwidthLimits{Ingress: "100mbit", Egress: "10mbit"}, true},
+		{bandwidthLimits{Ingress: "1tbps"}, true},
+		/* the police action takes the rate as 32 bits of bytes per second */
+		{bandwidthLimits{Egress: "4294967295bps"}, true},
+		{bandwidthLimits{Egress: "4294967296bps"}, false},
+		{bandwidthLimits{Egress: "40gbit"}, false},
+		{bandwidthLimits{Ingress: "fast"}, false},
+		{bandwidthLimits{Egress: "0kbit"}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.limits.check()
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v.check() = %v, want ok %v", tt.limits, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var (
+	flagStateDir = flag.String("statedir", "/var/lib/envdeploy", "path to directory where to keep job state across restarts")
+)
+
+/* jobRecord is the on-disk form of a job, rewritten on every state change */
+type jobRecord struct {
+	ID         string            `json:"ID"`
+	Owner      user              `json:"Owner"`
+	Deployable string            `json:"Deployable"`
+	Params     map[string]string `json:"Params"`
+	Profile    string            `json:"Profile"`
+	Public     bool              `json:"Public"`
+
+	Cgroup   string `json:"Cgroup"`
+	StderrFn string `json:"StderrFn"`
+
+	Upstream upstreamConfig `json:"Upstream"`
+
+	HostIf     string `json:"HostIf"`
+	HostIP     string `json:"HostIP"`
+	GuestIP    string `json:"GuestIP"`
+	PrefixLen  int    `json:"PrefixLen"`
+	HostIP6    string `json:"HostIP6,omitempty"`
+	GuestIP6   string `json:"GuestIP6,omitempty"`
+	PrefixLen6 int    `json:"PrefixLen6,omitempty"`
+
+	Bandwidth bandwidthLimits `json:"Bandwidth"`
+
+	Started    bool      `json:"Started"`
+	StartTime  time.Time `json:"StartTime"`
+	Finished   bool      `json:"Finished"`
+	FinishTime time.Time `json:"FinishTime"`
+	Ready      bool      `json:"Ready"`
+
+	EntryPid    int    `json:"EntryPid"`
+	EntryExited bool   `json:"EntryExited"`
+	ExitCode    int    `json:"ExitCode"`
+	ExitSignal  string `json:"ExitSignal"`
+	Outcome     string `json:"Outcome"`
+	FailReason  string `json:"FailReason"`
+}
+
+func jobRecordPath(id string) string {
+	return path.Join(*flagStateDir, id+".json")
+}
+
+func initStore() {
+	err := os.MkdirAll(*flagStateDir, 0750)
+	if err != nil {
+		log.Fatalf("could not create state directory: %s", err)
+	}
+}
+
+func (j *job) record() jobRecord {
+	j.Statem.RLock()
+	defer j.Statem.RUnlock()
+
+	return jobRecord{
+		ID:         j.ID,
+		Owner:      j.Owner,
+		Deployable: j.Deployable,
+		Params:     j.Params,
+		Profile:    j.Profile,
+		Public:     j.Public,
+		Cgroup:     j.Cgroup,
+		StderrFn:   j.StderrFn,
+		Upstream:   j.Upstream,
+		HostIf:     j.HostIf,
+		HostIP:     j.HostIP,
+		GuestIP:    j.GuestIP,
+		PrefixLen:  j.PrefixLen,
+		HostIP6:    j.HostIP6,
+		GuestIP6:   j.GuestIP6,
+		PrefixLen6: j.PrefixLen6,
+		Bandwidth:  j.Bandwidth,
+		Started:    j.Started,
+		StartTime:  j.StartTime,
+		Finished:   j.Finished,
+		FinishTime: j.FinishTime,
+		Ready:      j.Ready,
+
+		EntryPid:    j.EntryPid,
+		EntryExited: j.EntryExited,
+		ExitCode:    j.ExitCode,
+		ExitSignal:  j.ExitSignal,
+		Outcome:     j.Outcome,
+		FailReason:  j.FailReason,
+	}
+}
+
+/* save atomically replaces the job's record; saves are serialized and none recreates that of a removed job */
+func (j *job) save() {
+	j.Savem.Lock()
+	defer j.Savem.Unlock()
+	if j.Removed {
+		return
+	}
+
+	contents, err := json.MarshalIndent(j.record(), "", "\t")
+	if err != nil {
+		log.Printf("encoding state of job %s: %s", j.ID, err)
+		return
+	}
+
+	fn := jobRecordPath(j.ID)
+	tmpFn := fn + ".tmp"
+	err = ioutil.WriteFile(tmpFn, contents, 0640)
+	if err == nil {
+		err = os.Rename(tmpFn, fn)
+	}
+	if err != nil {
+		log.Printf("saving state of job %s: %s", j.ID, err)
+	}
+}
+
+func discardJobRecord(id string) {
+	err := os.Remove(jobRecordPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("removing state of job %s: %s", id, err)
+	}
+}
+
+func readJobRecords() (ret []jobRecord, err error) {
+	fns, err := filepath.Glob(path.Join(*flagStateDir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, fn := range fns {
+		var rec jobRecord
+
+		contents, err := ioutil.ReadFile(fn)
+		if err == nil {
+			err = json.Unmarshal(contents, &rec)
+		}
+		if err == nil && rec.ID+".json" != path.Base(fn) {
+			err = errJobRecordMismatch
+		}
+		if err != nil {
+			log.Printf("skipping job record %s: %s", fn, err)
+			continue
+		}
+		ret = append(ret, rec)
+	}
+	return
+}
+
+/* restoreJob rebuilds a job from its record as found at start-up */
+func restoreJob(rec jobRecord) (*job, error) {
+	stderr, err := os.OpenFile(rec.StderrFn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	j := newJob(rec.ID, rec.Owner, rec.Cgroup, stderr, rec.StderrFn, rec.Upstream)
+	j.Deployable = rec.Deployable
+	j.Params = rec.Params
+	j.Profile = rec.Profile
+	j.Public = rec.Public
+	j.setVeth(vethInfo{rec.HostIf, rec.HostIP, rec.GuestIP, rec.PrefixLen, rec.HostIP6, rec.GuestIP6, rec.PrefixLen6})
+	j.Bandwidth = rec.Bandwidth
+	j.Started = rec.Started
+	j.StartTime = rec.StartTime
+	j.Finished = rec.Finished
+	j.FinishTime = rec.FinishTime
+	j.Ready = rec.Ready
+	j.EntryPid = rec.EntryPid
+	j.EntryExited = rec.EntryExited
+	j.ExitCode = rec.ExitCode
+	j.ExitSignal = rec.ExitSignal
+	j.Outcome = rec.Outcome
+	j.FailReason = rec.FailReason
+	j.LastActivity = time.Now()
+
+	if !j.Finished {
+		/* a job which never got started won't be started anymore */
+		_, err := os.Stat(j.Cgroup)
+		if !j.Started || os.IsNotExist(err) {
+			j.Finished = true
+			j.FinishTime = time.Now()
+			j.Outcome = j.outcome()
+		}
+	}
+
+	return j, nil
+}
+
+func loadJobs() {
+	recs, err := readJobRecords()
+	if err != nil {
+		log.Fatalf("could not read job records: %s", err)
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	for _, rec := range recs {
+		j, err := restoreJob(rec)
+		if err != nil {
+			log.Printf("restoring job %s: %s", rec.ID, err)
+			continue
+		}
+		jobs.m[j.ID] = j
+		j.save()
+	}
+	log.Printf("restored %d jobs from %s", len(jobs.m), *flagStateDir)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	osuser "os/user"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var (
+	errNoSystemUser = errors.New("upstream sockets need a system user of the job's owner")
+)
+
+var (
+	flagRunDir = flag.String("rundir", "/run/envdeploy", "path to directory where to create job-private directories for upstream sockets")
+)
+
+const defaultUpstreamAddr = "127.0.0.1:8000"
+
+/* upstreamConfig says where and how a job serves HTTP within its network namespace */
+type upstreamConfig struct {
+	/* host:port, defaults to 127.0.0.1:8000; an IPv6 upstream is
+	   given as e.g. [::1]:8000 */
+	Addr string `json:"Addr"`
+	/* "http" (the default), "https" with any certificate accepted, or "h2c" */
+	Scheme string `json:"Scheme"`
+
+	/* if set, the job's web base path is replaced by PathPrefix in requests */
+	RewritePath bool   `json:"RewritePath"`
+	PathPrefix  string `json:"PathPrefix"`
+
+	/* if set, the upstream listens on a Unix socket of this name in a
+	   directory private to the job, and Addr is only used for the Host
+	   header; in a job's own copy this is the full path to the socket;
+	   the directory belongs to the owner's system user, so owners
+	   without one cannot deploy */
+	Socket string `json:"Socket"`
+}
+
+func (u upstreamConfig) withDefaults() upstreamConfig {
+	if u.Addr == "" {
+		u.Addr = defaultUpstreamAddr
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return u
+}
+
+func (u upstreamConfig) check() error {
+	u = u.withDefaults()
+	_, _, err := net.SplitHostPort(u.Addr)
+	if err != nil {
+		return fmt.Errorf("bad upstream address: %s", err)
+	}
+	if strings.Contains(u.Socket, "/") || u.Socket == "." || u.Socket == ".." {
+		return fmt.Errorf("bad upstream socket name %q", u.Socket)
+	}
+	switch u.Scheme {
+	case "http", "https", "h2c":
+		return nil
+	default:
+		return fmt.Errorf("unknown upstream scheme %q", u.Scheme)
+	}
+}
+
+/* Port is the upstream port, as passed to the launch script */
+func (u upstreamConfig) Port() string {
+	_, port, _ := net.SplitHostPort(u.withDefaults().Addr)
+	return port
+}
+
+func (u upstreamConfig) Host() string {
+	host, _, _ := net.SplitHostPort(u.withDefaults().Addr)
+	return host
+}
+
+/* dial connects to the upstream from within the job's network namespace */
+func (u upstreamConfig) dial(ctx context.Context, pd *pinnedDialer) (net.Conn, error) {
+	if u.Socket != "" {
+		return pd.DialContext(ctx, "unix", u.Socket)
+	}
+	return pd.DialContext(ctx, "tcp", u.withDefaults().Addr)
+}
+
+/* activityConn calls touch whenever data goes over the connection */
+type activityConn struct {
+	net.Conn
+	touch func()
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+/* newUpstreamTransport makes a transport speaking the upstream's scheme over pd */
+func newUpstreamTransport(u upstreamConfig, pd *pinnedDialer, touch func()) http.RoundTripper {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := u.dial(ctx, pd)
+		if err != nil {
+			return nil, err
+		}
+		return &activityConn{conn, touch}, nil
+	}
+
+	if u.withDefaults().Scheme == "h2c" {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			DisableCompression: true,
+		}
+	}
+
+	return &http.Transport{
+		DialContext:         dial,
+		MaxIdleConns:        24,
+		IdleConnTimeout:     1 * time.Hour,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		DisableCompression:  true,
+	}
+}
+
+/* upstreamDirector points requests to the gateway of job id at the upstream */
+func upstreamDirector(u upstreamConfig, id string) func(req *http.Request) {
+	u = u.withDefaults()
+	scheme := u.Scheme
+	if scheme == "h2c" {
+		scheme = "http"
+	}
+	gatewayPath := "/enter/" + id
+
+	return func(req *http.Request) {
+		if u.RewritePath {
+			req.URL.Path = u.PathPrefix + strings.TrimPrefix(req.URL.Path, gatewayPath)
+			req.URL.RawPath = ""
+		} else {
+			req.URL.Path = *flagBasePath + req.URL.Path
+		}
+		req.URL.Scheme = scheme
+		req.URL.Host = u.Addr
+	}
+}
+
+/* socketDir is where the upstream socket of job id is kept */
+func socketDir(id string) string {
+	return path.Join(*flagRunDir, id)
+}
+
+// createSocketDir creates the directory private to job id which holds its
+// upstream socket. The directory is handed over to the system user of the
+// job's owner, so a socket upstream cannot be deployed by users without one.
+func createSocketDir(id string, owner user) (string, error) {
+	sysUser, err := osuser.Lookup(string(owner))
+	if err != nil {
+		return "", errNoSystemUser
+	}
+	uid, _ := strconv.Atoi(sysUser.Uid)
+	gid, _ := strconv.Atoi(sysUser.Gid)
+
+	dir := socketDir(id)
+	err = os.MkdirAll(*flagRunDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	err = os.Chown(dir, uid, gid)
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+/* removeSocketDir removes the socket directory of job id, and nothing else */
+func removeSocketDir(id string) error {
+	dir := socketDir(id)
+	if !reJobID.MatchString(id) || path.Dir(dir) != path.Clean(*flagRunDir) {
+		return fmt.Errorf("refusing to remove %s", dir)
+	}
+	return os.RemoveAll(dir)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	osuser "os/user"
 	"strings"
 )
 
@@ -31,3 +32,25 @@ func (u user) CanAccessJob(j *job) bool {
 func (u user) CanManageJob(j *job) bool {
 	return u == j.Owner || u.IsAdmin()
 }
+
+/* InGroup tells whether the system user of the same name is a member of the system group */
+func (u user) InGroup(name string) bool {
+	sysUser, err := osuser.Lookup(string(u))
+	if err != nil {
+		return false
+	}
+	group, err := osuser.LookupGroup(name)
+	if err != nil {
+		return false
+	}
+	gids, err := sysUser.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, gid := range gids {
+		if gid == group.Gid {
+			return true
+		}
+	}
+	return false
+}